@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+
+	spamservice "katanaid/services/spam-service"
+)
+
+const cliUsage = `Usage:
+  katanaid                     start the API server
+  katanaid spam check [flags] [file]
+                               check addresses from a CSV or list file, or stdin
+  katanaid help                show this message
+`
+
+// commands are the subcommands, by first argument. Each gets the arguments
+// after its name and returns the process exit code
+var commands = map[string]func(args []string) int{
+	"spam": runSpamCommand,
+	"help": func(args []string) int {
+		fmt.Fprint(os.Stdout, cliUsage)
+		return 0
+	},
+}
+
+// runCommand runs the subcommand named by args[0]. Anything else is refused
+// with the usage rather than falling through to the server
+func runCommand(args []string) int {
+	run, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n%s", args[0], cliUsage)
+		return 2
+	}
+	return run(args[1:])
+}
+
+func runSpamCommand(args []string) int {
+	if len(args) >= 1 && args[0] == "check" {
+		return runSpamCheck(args[1:])
+	}
+
+	fmt.Fprint(os.Stderr, cliUsage)
+	return 2
+}
+
+// runSpamCheck runs the email checks without the server or database, writing
+// one result per address to stdout (or -o) and a summary to stderr
+func runSpamCheck(args []string) int {
+	flags := flag.NewFlagSet("katanaid spam check", flag.ContinueOnError)
+	format := flags.String("format", "jsonl", "output format: jsonl or csv")
+	dns := flags.Bool("dns", false, "look up MX, SPF and DMARC records")
+	smtp := flags.Bool("smtp", false, "probe mailboxes over SMTP (implies -dns)")
+	output := flags.String("o", "", "write results to this file instead of stdout")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() > 1 {
+		fmt.Fprintln(os.Stderr, "Only one input file may be given")
+		return 2
+	}
+
+	var in io.Reader = os.Stdin
+	if path := flags.Arg(0); path != "" && path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer f.Close()
+		in = f
+	}
+
+	var out io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer f.Close()
+		out = f
+	}
+
+	// The same data files and settings as the server
+	if err := spamservice.InitBlocklist(); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to load disposable email blocklist:", err)
+		return 1
+	}
+	if err := spamservice.InitScoringRules(); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to load scoring rules:", err)
+		return 1
+	}
+	if err := spamservice.InitResolver(); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to configure DNS resolver:", err)
+		return 1
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	summary, err := spamservice.CheckEmailStream(ctx, in, out, spamservice.OfflineOptions{
+		DNS:    *dns || *smtp,
+		SMTP:   *smtp,
+		Format: *format,
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	fmt.Fprintf(os.Stderr, "Checked %d: %d safe, %d suspicious, %d risky\n",
+		summary.Total, summary.Safe, summary.Suspicious, summary.Risky)
+	return 0
+}
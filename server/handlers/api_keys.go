@@ -0,0 +1,197 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"katanaid/database"
+	"katanaid/middleware"
+	"katanaid/models"
+	"katanaid/util"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	apiKeyPrefix      = "kid_"
+	maxAPIKeysPerUser = 20
+)
+
+// =============================================================================
+// TYPES
+// =============================================================================
+
+type CreateAPIKeyRequest struct {
+	Name string `json:"name"`
+}
+
+type APIKeyResponse struct {
+	ID         int     `json:"id"`
+	Name       string  `json:"name"`
+	Prefix     string  `json:"prefix"`
+	Key        string  `json:"key,omitempty"` // only set when the key is created
+	CreatedAt  string  `json:"created_at"`
+	LastUsedAt *string `json:"last_used_at,omitempty"`
+}
+
+// =============================================================================
+// HANDLERS
+// =============================================================================
+
+// ListAPIKeys returns the caller's active keys without their secrets
+func ListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	user, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		util.WriteJSON(w, http.StatusUnauthorized, models.ErrorResponse{Error: "Unauthorized"})
+		return
+	}
+
+	rows, err := database.DB.Query(
+		context.Background(),
+		`SELECT id, name, key_prefix, created_at, last_used_at
+		FROM api_keys WHERE user_id = $1 AND revoked_at IS NULL
+		ORDER BY created_at`,
+		user.UserID,
+	)
+	if err != nil {
+		log.Printf("Error listing API keys: %v", err)
+		util.WriteJSON(w, http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to list API keys"})
+		return
+	}
+	defer rows.Close()
+
+	keys := []APIKeyResponse{}
+	for rows.Next() {
+		var key APIKeyResponse
+		var createdAt time.Time
+		var lastUsedAt *time.Time
+		if err := rows.Scan(&key.ID, &key.Name, &key.Prefix, &createdAt, &lastUsedAt); err != nil {
+			log.Printf("Error scanning API key: %v", err)
+			continue
+		}
+		key.CreatedAt = createdAt.UTC().Format(time.RFC3339)
+		if lastUsedAt != nil {
+			formatted := lastUsedAt.UTC().Format(time.RFC3339)
+			key.LastUsedAt = &formatted
+		}
+		keys = append(keys, key)
+	}
+
+	util.WriteJSON(w, http.StatusOK, keys)
+}
+
+// CreateAPIKey issues a new key. The raw key is returned once and only its
+// hash is stored
+func CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	user, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		util.WriteJSON(w, http.StatusUnauthorized, models.ErrorResponse{Error: "Unauthorized"})
+		return
+	}
+
+	var req CreateAPIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		util.WriteJSON(w, http.StatusBadRequest, models.ErrorResponse{Error: "Invalid request body"})
+		return
+	}
+
+	name := strings.TrimSpace(req.Name)
+	if len(name) > 100 {
+		util.WriteJSON(w, http.StatusBadRequest, models.ErrorResponse{Error: "Name cannot exceed 100 characters"})
+		return
+	}
+
+	var count int
+	err := database.DB.QueryRow(
+		context.Background(),
+		`SELECT COUNT(*) FROM api_keys WHERE user_id = $1 AND revoked_at IS NULL`,
+		user.UserID,
+	).Scan(&count)
+	if err != nil {
+		log.Printf("Error counting API keys: %v", err)
+		util.WriteJSON(w, http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to create API key"})
+		return
+	}
+	if count >= maxAPIKeysPerUser {
+		util.WriteJSON(w, http.StatusBadRequest, models.ErrorResponse{Error: "API key limit reached"})
+		return
+	}
+
+	rawKey, err := generateAPIKey()
+	if err != nil {
+		log.Printf("Error generating API key: %v", err)
+		util.WriteJSON(w, http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to create API key"})
+		return
+	}
+
+	key := APIKeyResponse{Name: name, Prefix: rawKey[:len(apiKeyPrefix)+8], Key: rawKey}
+	var createdAt time.Time
+	err = database.DB.QueryRow(
+		context.Background(),
+		`INSERT INTO api_keys (user_id, key_hash, key_prefix, name)
+		VALUES ($1, $2, $3, $4) RETURNING id, created_at`,
+		user.UserID, middleware.HashAPIKey(rawKey), key.Prefix, name,
+	).Scan(&key.ID, &createdAt)
+	if err != nil {
+		log.Printf("Error creating API key: %v", err)
+		util.WriteJSON(w, http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to create API key"})
+		return
+	}
+	key.CreatedAt = createdAt.UTC().Format(time.RFC3339)
+
+	log.Printf("User %d created API key %d", user.UserID, key.ID)
+
+	util.WriteJSON(w, http.StatusCreated, key)
+}
+
+// RevokeAPIKey disables one of the caller's keys
+func RevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	user, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		util.WriteJSON(w, http.StatusUnauthorized, models.ErrorResponse{Error: "Unauthorized"})
+		return
+	}
+
+	keyID, err := strconv.Atoi(chi.URLParam(r, "keyID"))
+	if err != nil {
+		util.WriteJSON(w, http.StatusBadRequest, models.ErrorResponse{Error: "Invalid key ID"})
+		return
+	}
+
+	tag, err := database.DB.Exec(
+		context.Background(),
+		`UPDATE api_keys SET revoked_at = NOW()
+		WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL`,
+		keyID, user.UserID,
+	)
+	if err != nil {
+		log.Printf("Error revoking API key: %v", err)
+		util.WriteJSON(w, http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to revoke API key"})
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		util.WriteJSON(w, http.StatusNotFound, models.ErrorResponse{Error: "API key not found"})
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// =============================================================================
+// HELPERS
+// =============================================================================
+
+func generateAPIKey() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return apiKeyPrefix + hex.EncodeToString(b), nil
+}
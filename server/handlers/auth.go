@@ -18,6 +18,8 @@ import (
 
 	"katanaid/database"
 	"katanaid/models"
+	spamservice "katanaid/services/spam-service"
+	trustservice "katanaid/services/trust-service"
 	"katanaid/util"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -90,10 +92,11 @@ func Signup(w http.ResponseWriter, r *http.Request) {
 	var userID int
 	err = tx.QueryRow(
 		ctx,
-		"INSERT INTO users (username, email, password_hash) VALUES ($1, $2, $3) RETURNING id",
+		"INSERT INTO users (username, email, password_hash, canonical_email_hash) VALUES ($1, $2, $3, $4) RETURNING id",
 		username,
 		email,
 		string(hashedPassword),
+		spamservice.CanonicalEmailHash(email),
 	).Scan(&userID)
 
 	if err != nil {
@@ -251,6 +254,7 @@ func Login(w http.ResponseWriter, r *http.Request) {
 	}
 
 	log.Printf("User logged in: %s - %s", user.Username, user.Email)
+	go trustservice.RecordLogin(user.ID, util.ClientIP(r), "password")
 	util.WriteJSON(w, http.StatusOK, models.AuthSuccessResponse{
 		Token:         tokenString,
 		Username:      user.Username,
@@ -80,14 +80,13 @@ func GetDashboardStats(w http.ResponseWriter, r *http.Request) {
 	services = append(services, emailFraudUsage)
 	totalCalls += emailFraudUsage.TotalCalls
 
-	// CAPTCHA - from captcha_sessions table
+	// CAPTCHA - from captcha_usage, which counts stateless sessions too
 	captchaUsage := getGlobalServiceUsage(ctx, "CAPTCHA", "captcha",
-		`SELECT DATE(created_at) as date, COUNT(*) as count 
-		 FROM captcha_sessions 
-		 WHERE created_at >= $1 
-		 GROUP BY DATE(created_at) 
-		 ORDER BY date`,
-		`SELECT COUNT(*) FROM captcha_sessions WHERE created_at >= $1`,
+		`SELECT day as date, challenges as count 
+		 FROM captcha_usage 
+		 WHERE day >= $1 
+		 ORDER BY day`,
+		`SELECT COALESCE(SUM(challenges), 0) FROM captcha_usage WHERE day >= $1`,
 		startDate, days)
 	services = append(services, captchaUsage)
 	totalCalls += captchaUsage.TotalCalls
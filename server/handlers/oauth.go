@@ -17,6 +17,9 @@ import (
 	"time"
 
 	"katanaid/database"
+	spamservice "katanaid/services/spam-service"
+	trustservice "katanaid/services/trust-service"
+	"katanaid/util"
 
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/github"
@@ -194,7 +197,7 @@ func GoogleCallback(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Create or get user
-	jwtToken, err := findOrCreateOAuthUser(userInfo.Email, userInfo.Name, "google", userInfo.EmailVerified)
+	jwtToken, err := findOrCreateOAuthUser(userInfo.Email, userInfo.Name, "google", userInfo.EmailVerified, util.ClientIP(r))
 	if err != nil {
 		log.Printf("Failed to create/find user: %v", err)
 		redirectWithError(w, r, "Failed to create user")
@@ -302,7 +305,7 @@ func GitHubCallback(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Create or get user
-	jwtToken, err := findOrCreateOAuthUser(userInfo.Email, userInfo.Name, "github", userInfo.EmailVerified)
+	jwtToken, err := findOrCreateOAuthUser(userInfo.Email, userInfo.Name, "github", userInfo.EmailVerified, util.ClientIP(r))
 	if err != nil {
 		log.Printf("Failed to create/find user: %v", err)
 		redirectWithError(w, r, "Failed to create user")
@@ -421,7 +424,7 @@ func getGitHubEmail(client *http.Client) (string, bool) {
 // ==================== HELPERS ====================
 
 // findOrCreateOAuthUser finds existing user or creates new one
-func findOrCreateOAuthUser(email, name, provider string, emailVerified bool) (string, error) {
+func findOrCreateOAuthUser(email, name, provider string, emailVerified bool, ip string) (string, error) {
 	// Require verified email for security (relaxed for GitHub as their API is inconsistent)
 	if !emailVerified && provider != "github" {
 		log.Printf("Email not verified: provider=%s, email=%s, verified=%v", provider, email, emailVerified)
@@ -468,12 +471,13 @@ func findOrCreateOAuthUser(email, name, provider string, emailVerified bool) (st
 		oauthToken := base64.StdEncoding.EncodeToString(randomBytes)
 
 		err = tx.QueryRow(ctx,
-			`INSERT INTO users (username, email, password_hash, email_verified)
-			 VALUES ($1, $2, $3, TRUE)
+			`INSERT INTO users (username, email, password_hash, email_verified, canonical_email_hash)
+			 VALUES ($1, $2, $3, TRUE, $4)
 			 RETURNING id`,
 			username,
 			email,
 			"oauth:"+provider+":"+oauthToken,
+			spamservice.CanonicalEmailHash(email),
 		).Scan(&userID)
 
 		if err != nil {
@@ -490,6 +494,8 @@ func findOrCreateOAuthUser(email, name, provider string, emailVerified bool) (st
 		return "", fmt.Errorf("%w: %v", ErrDatabaseError, err)
 	}
 
+	go trustservice.RecordLogin(userID, ip, provider)
+
 	// Generate JWT token
 	return generateSignedToken(userID, username, email, true)
 }
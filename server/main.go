@@ -7,6 +7,10 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
 
 	"katanaid/database"
 	"katanaid/handlers"
@@ -15,6 +19,7 @@ import (
 	identityservice "katanaid/services/identity-service"
 	spamservice "katanaid/services/spam-service"
 	trustservice "katanaid/services/trust-service"
+	"katanaid/util"
 
 	_ "github.com/jackc/pgx/v5/stdlib"
 	"github.com/joho/godotenv"
@@ -33,6 +38,12 @@ func main() {
 		log.Println("Warning: .env file not found")
 	}
 
+	// Subcommands run offline, without the server's configuration. The server
+	// takes no arguments, so anything that isn't a known subcommand is an error
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:]))
+	}
+
 	requiredEnvs := []string{
 		"PORT",
 		"DATABASE_URL",
@@ -76,10 +87,47 @@ func main() {
 	database.Connect()
 	defer database.Close()
 
+	if err := util.InitTrustedProxies(); err != nil {
+		log.Fatal("Failed to configure trusted proxies:", err)
+	}
+
 	if err := handlers.InitOAuth(); err != nil {
 		log.Fatal("Failed to initialize OAuth:", err)
 	}
 
+	if err := captchaservice.Init(); err != nil {
+		log.Fatal("Failed to initialize CAPTCHA:", err)
+	}
+
+	if err := spamservice.InitBlocklist(); err != nil {
+		log.Fatal("Failed to load disposable email blocklist:", err)
+	}
+
+	if err := spamservice.InitScoringRules(); err != nil {
+		log.Fatal("Failed to load scoring rules:", err)
+	}
+
+	if err := spamservice.InitResolver(); err != nil {
+		log.Fatal("Failed to configure DNS resolver:", err)
+	}
+
+	if err := trustservice.InitIPIntel(); err != nil {
+		log.Fatal("Failed to load IP intelligence lists:", err)
+	}
+
+	if err := trustservice.InitGeoIP(); err != nil {
+		log.Fatal("Failed to open GeoIP databases:", err)
+	}
+
+	// Bulk verification jobs, IP velocity rollups and one-off backfills run in the background
+	spamservice.StartJobWorkers()
+	spamservice.StartCanonicalBackfill()
+	trustservice.StartVelocityRollup()
+	captchaservice.StartUsageFlush()
+
+	// Reload file-backed data on SIGHUP without dropping requests
+	go reloadOnSignal(spamservice.ReloadBlocklist, spamservice.ReloadScoringRules, trustservice.ReloadIPIntel, trustservice.ReloadGeoIP)
+
 	r := chi.NewRouter()
 
 	allowedOrigins := []string{os.Getenv("FRONTEND_URL")}
@@ -87,16 +135,29 @@ func main() {
 		allowedOrigins = append(allowedOrigins, os.Getenv("BACKEND_URL"))
 	}
 
+	// The CAPTCHA widget runs on integrators' sites, so its API accepts their origins too
+	widgetOrigins := strings.Split(os.Getenv("CAPTCHA_WIDGET_ORIGINS"), ",")
+
 	r.Use(cors.Handler(cors.Options{
-		AllowedOrigins:   allowedOrigins,
+		AllowOriginFunc: func(r *http.Request, origin string) bool {
+			if slices.Contains(allowedOrigins, origin) {
+				return true
+			}
+			if !strings.HasPrefix(r.URL.Path, "/api/captcha/") {
+				return false
+			}
+			return slices.Contains(widgetOrigins, "*") || slices.Contains(widgetOrigins, origin)
+		},
 		AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type"},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-API-Key"},
 		AllowCredentials: true,
 		MaxAge:           300,
 	}))
 
 	r.Get("/health", handlers.Health)
 
+	r.Handle("/widget/*", captchaservice.WidgetHandler())
+
 	r.Route("/auth", func(r chi.Router) {
 		r.Use(middleware.RateLimiterPerMinute(12))
 		r.Post("/signup", handlers.Signup)
@@ -114,6 +175,14 @@ func main() {
 	r.With(middleware.AuthMiddleware).Get("/user/profile", handlers.GetProfile)
 	r.With(middleware.AuthMiddleware).Patch("/user/profile", handlers.UpdateProfile)
 
+	r.Route("/user/api-keys", func(r chi.Router) {
+		r.Use(middleware.AuthMiddleware)
+		r.Use(middleware.RateLimiterPerMinute(30))
+		r.Get("/", handlers.ListAPIKeys)
+		r.Post("/", handlers.CreateAPIKey)
+		r.Delete("/{keyID}", handlers.RevokeAPIKey)
+	})
+
 	r.Route("/api", func(r chi.Router) {
 		r.Use(middleware.RateLimiterPerHour(3))
 		r.Post("/identity/username", identityservice.GenerateUsername)
@@ -128,20 +197,46 @@ func main() {
 
 	r.Route("/api/spam", func(r chi.Router) {
 		r.Use(middleware.RateLimiterPerMinute(30))
-		r.Post("/email-check", spamservice.CheckEmail)
-		r.Post("/email-bulk", spamservice.CheckEmailBulk)
+		r.With(middleware.APIKeyMiddleware).Post("/email-check", spamservice.CheckEmail)
+		r.With(middleware.APIKeyMiddleware).Post("/email-bulk", spamservice.CheckEmailBulk)
+		r.With(middleware.AdminMiddleware).Get("/admin/blocklist", spamservice.GetBlocklistInfo)
+		r.With(middleware.AdminMiddleware).Get("/domain/{domain}", spamservice.GetDomainReputation)
+
+		r.Route("/jobs", func(r chi.Router) {
+			r.Use(middleware.APIKeyMiddleware)
+			r.Post("/", spamservice.CreateEmailJob)
+			r.Get("/{jobID}", spamservice.GetEmailJob)
+			r.Get("/{jobID}/results", spamservice.GetEmailJobResults)
+		})
+
+		r.Route("/rules", func(r chi.Router) {
+			r.Use(middleware.AuthMiddleware)
+			r.Get("/", spamservice.ListEmailRules)
+			r.Post("/", spamservice.CreateEmailRule)
+			r.Delete("/{ruleID}", spamservice.DeleteEmailRule)
+		})
 	})
 
 	r.Route("/api/captcha", func(r chi.Router) {
 		r.Use(middleware.RateLimiterPerMinute(60))
 		r.Post("/create", captchaservice.CreateChallenge)
 		r.Post("/verify", captchaservice.VerifyChallenge)
+		r.Get("/audio/{sessionID}", captchaservice.GetAudioChallenge)
+		r.Get("/image/{sessionID}", captchaservice.GetImageChallenge)
+		r.Post("/redeem", captchaservice.RedeemToken)
 	})
 
 	r.Route("/api/trust", func(r chi.Router) {
 		r.Use(middleware.RateLimiterPerMinute(30))
-		r.Post("/score", trustservice.CalculateTrustScore)
+		r.With(middleware.APIKeyMiddleware).Post("/score", trustservice.CalculateTrustScore)
 		r.Post("/record", trustservice.RecordFingerprint)
+
+		r.Route("/policy", func(r chi.Router) {
+			r.Use(middleware.AuthMiddleware)
+			r.Get("/", trustservice.GetTrustPolicy)
+			r.Put("/", trustservice.UpdateTrustPolicy)
+			r.Get("/versions", trustservice.ListTrustPolicyVersions)
+		})
 	})
 
 	port := os.Getenv("PORT")
@@ -149,3 +244,18 @@ func main() {
 
 	log.Fatal(http.ListenAndServe(":"+port, r))
 }
+
+// reloadOnSignal runs every reloader each time the process receives SIGHUP
+func reloadOnSignal(reloaders ...func() error) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	for range signals {
+		log.Print("SIGHUP received, reloading data files")
+		for _, reload := range reloaders {
+			if err := reload(); err != nil {
+				log.Print("Reload failed:", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,25 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"os"
+)
+
+// AdminMiddleware guards operator endpoints with the ADMIN_TOKEN shared secret,
+// sent as the X-Admin-Token header. Without ADMIN_TOKEN set they stay closed
+func AdminMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		adminToken := os.Getenv("ADMIN_TOKEN")
+		provided := r.Header.Get("X-Admin-Token")
+
+		if adminToken == "" || subtle.ConstantTimeCompare([]byte(provided), []byte(adminToken)) != 1 {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"error": "Admin access required"}`))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
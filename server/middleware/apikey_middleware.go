@@ -0,0 +1,72 @@
+package middleware
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+
+	"katanaid/database"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const APIKeyContextKey contextKey = "api_key"
+
+type APIKey struct {
+	ID     int
+	UserID int
+}
+
+// APIKeyMiddleware resolves an optional X-API-Key header to the account that
+// owns it. Requests without the header pass through anonymously, but a key that
+// is unknown or revoked is rejected rather than silently ignored
+func APIKeyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rawKey := r.Header.Get("X-API-Key")
+		if rawKey == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var key APIKey
+		err := database.DB.QueryRow(
+			r.Context(),
+			`UPDATE api_keys SET last_used_at = NOW()
+			WHERE key_hash = $1 AND revoked_at IS NULL
+			RETURNING id, user_id`,
+			HashAPIKey(rawKey),
+		).Scan(&key.ID, &key.UserID)
+
+		if errors.Is(err, pgx.ErrNoRows) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error": "Invalid API key"}`))
+			return
+		}
+		if err != nil {
+			log.Print("Error looking up API key:", err)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error": "Failed to verify API key"}`))
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), APIKeyContextKey, key)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// GetAPIKeyFromContext returns the API key the request was made with, if any
+func GetAPIKeyFromContext(ctx context.Context) (APIKey, bool) {
+	key, ok := ctx.Value(APIKeyContextKey).(APIKey)
+	return key, ok
+}
+
+// HashAPIKey is how keys are stored; the raw key is only shown once
+func HashAPIKey(rawKey string) string {
+	hash := sha256.Sum256([]byte(rawKey))
+	return hex.EncodeToString(hash[:])
+}
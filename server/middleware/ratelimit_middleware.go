@@ -4,14 +4,22 @@ import (
 	"net/http"
 	"time"
 
+	"katanaid/util"
+
 	"github.com/go-chi/httprate"
 )
 
+// keyByClientIP buckets requests by util.ClientIP rather than httprate.KeyByIP,
+// which believes forwarding headers from anyone
+func keyByClientIP(r *http.Request) (string, error) {
+	return util.ClientIP(r), nil
+}
+
 func RateLimiterPerHour(limitPerHour int) func(http.Handler) http.Handler {
 	return httprate.Limit(
 		limitPerHour,
 		1*time.Hour,
-		httprate.WithKeyFuncs(httprate.KeyByIP),
+		httprate.WithKeyFuncs(keyByClientIP),
 		httprate.WithLimitHandler(func(w http.ResponseWriter, r *http.Request) {
 			w.Header().Set("Content-Type", "application/json")
 			w.WriteHeader(http.StatusTooManyRequests)
@@ -24,7 +32,7 @@ func RateLimiterPerMinute(limitPerMinute int) func(http.Handler) http.Handler {
 	return httprate.Limit(
 		limitPerMinute,
 		1*time.Minute,
-		httprate.WithKeyFuncs(httprate.KeyByIP),
+		httprate.WithKeyFuncs(keyByClientIP),
 		httprate.WithLimitHandler(func(w http.ResponseWriter, r *http.Request) {
 			w.Header().Set("Content-Type", "application/json")
 			w.WriteHeader(http.StatusTooManyRequests)
@@ -0,0 +1,7 @@
+-- +goose Up
+ALTER TABLE captcha_sessions ADD COLUMN mode VARCHAR(16) NOT NULL DEFAULT 'slash';
+ALTER TABLE captcha_sessions ADD COLUMN expected_answer VARCHAR(64);
+
+-- +goose Down
+ALTER TABLE captcha_sessions DROP COLUMN expected_answer;
+ALTER TABLE captcha_sessions DROP COLUMN mode;
@@ -0,0 +1,14 @@
+-- +goose Up
+-- Challenges created per day, counted whichever session store is in use
+CREATE TABLE captcha_usage (
+    day DATE PRIMARY KEY,
+    challenges INTEGER NOT NULL DEFAULT 0
+);
+
+INSERT INTO captcha_usage (day, challenges)
+SELECT DATE(created_at), COUNT(*) FROM captcha_sessions
+WHERE created_at IS NOT NULL
+GROUP BY DATE(created_at);
+
+-- +goose Down
+DROP TABLE IF EXISTS captcha_usage;
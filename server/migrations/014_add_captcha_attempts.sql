@@ -0,0 +1,9 @@
+-- +goose Up
+ALTER TABLE captcha_sessions ADD COLUMN attempts INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE captcha_sessions ADD COLUMN last_failure VARCHAR(32);
+ALTER TABLE captcha_sessions ADD COLUMN failure_reasons TEXT[] NOT NULL DEFAULT '{}';
+
+-- +goose Down
+ALTER TABLE captcha_sessions DROP COLUMN failure_reasons;
+ALTER TABLE captcha_sessions DROP COLUMN last_failure;
+ALTER TABLE captcha_sessions DROP COLUMN attempts;
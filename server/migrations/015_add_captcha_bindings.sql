@@ -0,0 +1,12 @@
+-- +goose Up
+ALTER TABLE captcha_sessions ADD COLUMN bound_ip VARCHAR(64);
+ALTER TABLE captcha_sessions ADD COLUMN fingerprint_id VARCHAR(64);
+ALTER TABLE captcha_sessions ADD COLUMN action VARCHAR(64);
+-- Set when the session's token is redeemed, so each token is accepted once
+ALTER TABLE captcha_sessions ADD COLUMN redeemed_at TIMESTAMP;
+
+-- +goose Down
+ALTER TABLE captcha_sessions DROP COLUMN redeemed_at;
+ALTER TABLE captcha_sessions DROP COLUMN action;
+ALTER TABLE captcha_sessions DROP COLUMN fingerprint_id;
+ALTER TABLE captcha_sessions DROP COLUMN bound_ip;
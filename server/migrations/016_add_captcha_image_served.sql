@@ -0,0 +1,5 @@
+-- +goose Up
+ALTER TABLE captcha_sessions ADD COLUMN image_served BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- +goose Down
+ALTER TABLE captcha_sessions DROP COLUMN image_served;
@@ -0,0 +1,29 @@
+-- +goose Up
+CREATE TABLE api_keys (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    key_hash VARCHAR(64) UNIQUE NOT NULL,
+    key_prefix VARCHAR(16) NOT NULL,
+    name VARCHAR(100) NOT NULL DEFAULT '',
+    last_used_at TIMESTAMP,
+    revoked_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE TABLE email_rules (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    kind VARCHAR(32) NOT NULL,
+    pattern VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP DEFAULT NOW(),
+    UNIQUE (user_id, kind, pattern)
+);
+
+CREATE INDEX idx_api_keys_user ON api_keys(user_id);
+CREATE INDEX idx_email_rules_user ON email_rules(user_id);
+
+-- +goose Down
+DROP INDEX IF EXISTS idx_email_rules_user;
+DROP INDEX IF EXISTS idx_api_keys_user;
+DROP TABLE IF EXISTS email_rules;
+DROP TABLE IF EXISTS api_keys;
@@ -0,0 +1,12 @@
+-- +goose Up
+ALTER TABLE spam_checks ADD COLUMN canonical_hash VARCHAR(64);
+ALTER TABLE users ADD COLUMN canonical_email_hash VARCHAR(64);
+
+CREATE INDEX idx_spam_checks_canonical_hash ON spam_checks(canonical_hash);
+CREATE INDEX idx_users_canonical_email_hash ON users(canonical_email_hash);
+
+-- +goose Down
+DROP INDEX IF EXISTS idx_users_canonical_email_hash;
+DROP INDEX IF EXISTS idx_spam_checks_canonical_hash;
+ALTER TABLE users DROP COLUMN canonical_email_hash;
+ALTER TABLE spam_checks DROP COLUMN canonical_hash;
@@ -0,0 +1,33 @@
+-- +goose Up
+CREATE TABLE email_jobs (
+    id VARCHAR(32) PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    status VARCHAR(16) NOT NULL DEFAULT 'pending',
+    smtp_check BOOLEAN NOT NULL DEFAULT FALSE,
+    total INTEGER NOT NULL,
+    processed INTEGER NOT NULL DEFAULT 0,
+    created_at TIMESTAMP DEFAULT NOW(),
+    started_at TIMESTAMP,
+    completed_at TIMESTAMP
+);
+
+CREATE TABLE email_job_items (
+    id BIGSERIAL PRIMARY KEY,
+    job_id VARCHAR(32) NOT NULL REFERENCES email_jobs(id) ON DELETE CASCADE,
+    position INTEGER NOT NULL,
+    email TEXT NOT NULL,
+    status VARCHAR(16) NOT NULL DEFAULT 'pending',
+    claimed_at TIMESTAMP,
+    suggestion VARCHAR(16),
+    result JSONB,
+    UNIQUE (job_id, position)
+);
+
+CREATE INDEX idx_email_jobs_user ON email_jobs(user_id);
+CREATE INDEX idx_email_job_items_open ON email_job_items(status, id) WHERE status != 'done';
+
+-- +goose Down
+DROP INDEX IF EXISTS idx_email_job_items_open;
+DROP INDEX IF EXISTS idx_email_jobs_user;
+DROP TABLE IF EXISTS email_job_items;
+DROP TABLE IF EXISTS email_jobs;
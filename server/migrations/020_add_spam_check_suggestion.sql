@@ -0,0 +1,8 @@
+-- +goose Up
+ALTER TABLE spam_checks ADD COLUMN suggestion VARCHAR(16);
+
+CREATE INDEX idx_spam_checks_domain_checked_at ON spam_checks(domain, checked_at);
+
+-- +goose Down
+DROP INDEX IF EXISTS idx_spam_checks_domain_checked_at;
+ALTER TABLE spam_checks DROP COLUMN suggestion;
@@ -0,0 +1,15 @@
+-- +goose Up
+-- Each change inserts a new version; the highest version is the one in force
+CREATE TABLE trust_policies (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    version INTEGER NOT NULL,
+    signals JSONB NOT NULL,
+    block_below DOUBLE PRECISION NOT NULL,
+    captcha_below DOUBLE PRECISION NOT NULL,
+    created_at TIMESTAMP DEFAULT NOW(),
+    UNIQUE (user_id, version)
+);
+
+-- +goose Down
+DROP TABLE IF EXISTS trust_policies;
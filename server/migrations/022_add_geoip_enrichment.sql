@@ -0,0 +1,29 @@
+-- +goose Up
+ALTER TABLE device_fingerprints
+    ADD COLUMN country VARCHAR(2),
+    ADD COLUMN region VARCHAR(10),
+    ADD COLUMN asn BIGINT,
+    ADD COLUMN as_org VARCHAR(255);
+
+CREATE TABLE login_events (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    method VARCHAR(16) NOT NULL,
+    ip_address VARCHAR(45) NOT NULL,
+    country VARCHAR(2),
+    region VARCHAR(10),
+    asn BIGINT,
+    as_org VARCHAR(255),
+    created_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE INDEX idx_login_events_user ON login_events(user_id, created_at);
+
+-- +goose Down
+DROP INDEX IF EXISTS idx_login_events_user;
+DROP TABLE IF EXISTS login_events;
+ALTER TABLE device_fingerprints
+    DROP COLUMN as_org,
+    DROP COLUMN asn,
+    DROP COLUMN region,
+    DROP COLUMN country;
@@ -0,0 +1,49 @@
+-- +goose Up
+-- Signups per address per hour; hours older than two days are rolled up into
+-- day buckets. ip_prefix is the /24 or /64 the address belongs to
+CREATE TABLE ip_signup_buckets (
+    ip_address VARCHAR(45) NOT NULL,
+    ip_prefix VARCHAR(49) NOT NULL,
+    granularity VARCHAR(4) NOT NULL,
+    bucket_start TIMESTAMP NOT NULL,
+    signup_count INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY (ip_address, granularity, bucket_start)
+);
+
+CREATE INDEX idx_ip_signup_buckets_prefix ON ip_signup_buckets(ip_prefix, bucket_start);
+CREATE INDEX idx_ip_signup_buckets_rollup ON ip_signup_buckets(granularity, bucket_start);
+
+-- Carry recent counters over as a day bucket on the last signup, so addresses
+-- active this week aren't new again. The counters are lifetime totals, which
+-- overstates the week rather than forgetting it. ip_prefix matches ipPrefix in
+-- velocity.go: the /24 or /64, or the address itself when it doesn't parse
+INSERT INTO ip_signup_buckets (ip_address, ip_prefix, granularity, bucket_start, signup_count)
+SELECT
+    ip_address,
+    CASE
+        WHEN ip_address ~ '^[0-9]{1,3}(\.[0-9]{1,3}){3}$' THEN network(set_masklen(ip_address::inet, 24))::text
+        WHEN ip_address ~ '^[0-9a-fA-F:]*:[0-9a-fA-F:.]*$' THEN network(set_masklen(ip_address::inet, 64))::text
+        ELSE ip_address
+    END,
+    'day',
+    date_trunc('day', MAX(last_signup_at)),
+    SUM(signup_count)
+FROM ip_signups
+WHERE last_signup_at >= date_trunc('day', NOW()) - INTERVAL '6 days'
+GROUP BY ip_address;
+
+DROP TABLE IF EXISTS ip_signups;
+
+-- +goose Down
+CREATE TABLE ip_signups (
+    id SERIAL PRIMARY KEY,
+    ip_address VARCHAR(45) NOT NULL,
+    signup_count INTEGER DEFAULT 1,
+    first_signup_at TIMESTAMP DEFAULT NOW(),
+    last_signup_at TIMESTAMP DEFAULT NOW()
+);
+CREATE INDEX idx_ip_signups_ip ON ip_signups(ip_address);
+
+DROP INDEX IF EXISTS idx_ip_signup_buckets_rollup;
+DROP INDEX IF EXISTS idx_ip_signup_buckets_prefix;
+DROP TABLE IF EXISTS ip_signup_buckets;
@@ -0,0 +1,355 @@
+package captchaservice
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"math"
+	mrand "math/rand/v2"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+
+	"katanaid/models"
+	"katanaid/util"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// =============================================================================
+// CONSTANTS
+// =============================================================================
+
+// The accessible modes serve different users. Keyboard mode is for sighted
+// users who can't drag a pointer: the sequence is only ever drawn, since a
+// text version would be read by bots as easily as by screen readers. Audio
+// mode is the route for screen-reader and low-vision users, and the keyboard
+// picture's alt text points them to it
+const (
+	KeyboardSequence ChallengeType = "keyboard_sequence" // Arrow keys in order
+	AudioDigits      ChallengeType = "audio_digits"      // Count the beeps
+)
+
+const (
+	KeySequenceLength = 4
+	AudioDigitCount   = 4
+	MinKeyboardAnswer = 1500 * time.Millisecond // nobody reads four arrows and presses them faster
+
+	KeyboardInstruction = "Press the arrow keys shown in the picture, from left to right"
+	KeyboardAltText     = "Picture of arrows to press with the arrow keys. If you use a screen reader, switch to the audio challenge."
+	AudioInstruction    = "Listen and type the digits you hear. Each digit is a group of short beeps, a long tone means zero."
+)
+
+var arrowKeys = []string{"up", "down", "left", "right"}
+
+// Audio synthesis parameters (8 kHz, 8-bit mono PCM keeps the file small)
+const (
+	audioSampleRate = 8000
+	beepDuration    = 120 * time.Millisecond
+	beepGap         = 130 * time.Millisecond
+	zeroDuration    = 600 * time.Millisecond
+	digitGap        = 900 * time.Millisecond
+	leadIn          = 500 * time.Millisecond
+)
+
+// =============================================================================
+// HANDLERS
+// =============================================================================
+
+// GetAudioChallenge streams the WAV rendering of an audio challenge
+func GetAudioChallenge(w http.ResponseWriter, r *http.Request) {
+	session, err := store.Peek(r.Context(), chi.URLParam(r, "sessionID"))
+	if errors.Is(err, ErrSessionUsed) || errors.Is(err, ErrSessionExpired) {
+		util.WriteJSON(w, http.StatusGone, models.ErrorResponse{Error: "Session expired"})
+		return
+	}
+	if err != nil || session.Mode != ModeAudio || session.ExpectedAnswer == "" {
+		util.WriteJSON(w, http.StatusNotFound, models.ErrorResponse{Error: "Invalid session"})
+		return
+	}
+
+	w.Header().Set("Content-Type", "audio/wav")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	w.Write(renderDigitAudio(session.ExpectedAnswer))
+}
+
+// =============================================================================
+// GENERATORS
+// =============================================================================
+
+func generateKeySequence() []string {
+	keys := make([]string, KeySequenceLength)
+	for i := range keys {
+		keys[i] = arrowKeys[randomIndex(len(arrowKeys))]
+	}
+	return keys
+}
+
+func generateDigits() string {
+	digits := make([]byte, AudioDigitCount)
+	for i := range digits {
+		digits[i] = byte('0' + randomIndex(10))
+	}
+	return string(digits)
+}
+
+// =============================================================================
+// VALIDATION
+// =============================================================================
+
+// validateAnswer checks a typed answer. Timing is measured from when the
+// session was created, never taken from the client
+func validateAnswer(req VerifyRequest, session challengeSession) string {
+	expected := session.ExpectedAnswer
+	if expected == "" {
+		return "invalid_session"
+	}
+
+	var answer string
+	var minElapsed time.Duration
+	switch session.Mode {
+	case ModeKeyboard:
+		// The sequence only exists in the picture, which has to be fetched first
+		if !session.ImageServed {
+			return "image_not_served"
+		}
+		answer = normalizeKeyAnswer(req.Answer)
+		minElapsed = MinKeyboardAnswer
+	case ModeAudio:
+		answer = normalizeDigitAnswer(req.Answer)
+		minElapsed = digitAudioDuration(expected)
+	}
+
+	if time.Since(session.CreatedAt) < minElapsed {
+		return "too_fast"
+	}
+
+	if answer != expected {
+		return "wrong_answer"
+	}
+
+	return ""
+}
+
+// normalizeKeyAnswer accepts "up,left", "ArrowUp ArrowLeft" or "Up Left"
+func normalizeKeyAnswer(answer string) string {
+	fields := strings.FieldsFunc(strings.ToLower(answer), func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+	for i, field := range fields {
+		fields[i] = strings.TrimPrefix(field, "arrow")
+	}
+	return strings.Join(fields, " ")
+}
+
+// normalizeDigitAnswer drops anything that isn't a digit ("4 1 9 0" -> "4190")
+func normalizeDigitAnswer(answer string) string {
+	var b strings.Builder
+	for _, r := range answer {
+		if r >= '0' && r <= '9' {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// =============================================================================
+// AUDIO SYNTHESIS
+// =============================================================================
+
+// renderDigitAudio encodes each digit as a group of beeps (a long tone for
+// zero). Each beep gets its own pitch around a randomized base, so clips
+// differ between challenges and a beep can't be found by matching one tone
+func renderDigitAudio(digits string) []byte {
+	base := 500.0 + float64(randomIndex(200)*2)
+	pitch := func() float64 {
+		return base * (0.85 + mrand.Float64()*0.3)
+	}
+
+	samples := silence(leadIn)
+	for i, digit := range digits {
+		if i > 0 {
+			samples = append(samples, silence(digitGap)...)
+		}
+
+		if digit == '0' {
+			samples = append(samples, tone(pitch()*0.75, zeroDuration)...)
+			continue
+		}
+
+		for beep := 0; beep < int(digit-'0'); beep++ {
+			if beep > 0 {
+				samples = append(samples, silence(beepGap)...)
+			}
+			samples = append(samples, tone(pitch(), beepDuration)...)
+		}
+	}
+	samples = append(samples, silence(leadIn)...)
+
+	return encodeWAV(samples)
+}
+
+// digitAudioDuration is how long the clip for the digits plays, the least time
+// a listener needs before answering
+func digitAudioDuration(digits string) time.Duration {
+	total := 2 * leadIn
+	for i, digit := range digits {
+		if i > 0 {
+			total += digitGap
+		}
+		if digit == '0' {
+			total += zeroDuration
+			continue
+		}
+		beeps := time.Duration(digit - '0')
+		total += beeps*beepDuration + (beeps-1)*beepGap
+	}
+	return total
+}
+
+func tone(frequency float64, duration time.Duration) []byte {
+	count := sampleCount(duration)
+	fade := count / 10
+	out := make([]byte, count)
+
+	for i := range out {
+		// Short fade in/out avoids clicks at the beep edges
+		envelope := 1.0
+		if i < fade {
+			envelope = float64(i) / float64(fade)
+		} else if i > count-fade {
+			envelope = float64(count-i) / float64(fade)
+		}
+
+		value := math.Sin(2*math.Pi*frequency*float64(i)/audioSampleRate) * envelope * 0.6
+		out[i] = byte(128 + value*127 + noise())
+	}
+
+	return out
+}
+
+func silence(duration time.Duration) []byte {
+	out := make([]byte, sampleCount(duration))
+	for i := range out {
+		out[i] = byte(128 + noise())
+	}
+	return out
+}
+
+func sampleCount(duration time.Duration) int {
+	return int(duration.Seconds() * audioSampleRate)
+}
+
+// noise adds a little hiss in the range [-2, 2]
+func noise() float64 {
+	return float64(mrand.IntN(5) - 2)
+}
+
+func encodeWAV(samples []byte) []byte {
+	var buf bytes.Buffer
+
+	buf.WriteString("RIFF")
+	binary.Write(&buf, binary.LittleEndian, uint32(36+len(samples)))
+	buf.WriteString("WAVE")
+
+	// fmt chunk: PCM, mono, 8-bit
+	buf.WriteString("fmt ")
+	binary.Write(&buf, binary.LittleEndian, uint32(16))
+	binary.Write(&buf, binary.LittleEndian, uint16(1))
+	binary.Write(&buf, binary.LittleEndian, uint16(1))
+	binary.Write(&buf, binary.LittleEndian, uint32(audioSampleRate))
+	binary.Write(&buf, binary.LittleEndian, uint32(audioSampleRate))
+	binary.Write(&buf, binary.LittleEndian, uint16(1))
+	binary.Write(&buf, binary.LittleEndian, uint16(8))
+
+	buf.WriteString("data")
+	binary.Write(&buf, binary.LittleEndian, uint32(len(samples)))
+	buf.Write(samples)
+
+	return buf.Bytes()
+}
+
+// =============================================================================
+// KEY SEQUENCE IMAGE
+// =============================================================================
+
+const KeyImageHeight = 120
+
+// keyDirections is the unit vector each arrow points along, in image space
+var keyDirections = map[string][2]float64{
+	"up":    {0, -1},
+	"down":  {0, 1},
+	"left":  {-1, 0},
+	"right": {1, 0},
+}
+
+// renderKeySequence draws the sequence as jittered, slightly bent arrows over
+// a noisy background, so the keys are only available as pixels
+func renderKeySequence(keys []string) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, ImageWidth, KeyImageHeight))
+
+	for y := 0; y < KeyImageHeight; y++ {
+		for x := 0; x < ImageWidth; x++ {
+			n := uint8(mrand.IntN(18))
+			img.SetRGBA(x, y, color.RGBA{235 - n, 235 - n/2, 240, 255})
+		}
+	}
+
+	// Short unmarked strokes so the arrows can't be found as the only lines
+	for i := 0; i < DistractorCount; i++ {
+		from := [2]float64{mrand.Float64() * ImageWidth, mrand.Float64() * KeyImageHeight}
+		to := [2]float64{from[0] + (mrand.Float64()*2-1)*40, from[1] + (mrand.Float64()*2-1)*40}
+		drawCurve(img, from, to, bend(from, to), 2+mrand.Float64()*3, strokePalette[mrand.IntN(len(strokePalette))])
+	}
+
+	cell := float64(ImageWidth) / float64(len(keys))
+	for i, key := range keys {
+		direction := keyDirections[key]
+		length := 55 + mrand.Float64()*20
+		cx := cell*(float64(i)+0.5) + (mrand.Float64()*2-1)*8
+		cy := KeyImageHeight/2 + (mrand.Float64()*2-1)*10
+
+		// Tilt each arrow a little off its axis
+		tilt := (mrand.Float64()*2 - 1) * 0.25
+		dx := direction[0]*math.Cos(tilt) - direction[1]*math.Sin(tilt)
+		dy := direction[0]*math.Sin(tilt) + direction[1]*math.Cos(tilt)
+
+		arrow := imageGeometry{
+			StartX: cx - dx*length/2, StartY: cy - dy*length/2,
+			EndX: cx + dx*length/2, EndY: cy + dy*length/2,
+		}
+		from := [2]float64{arrow.StartX, arrow.StartY}
+		to := [2]float64{arrow.EndX, arrow.EndY}
+		ink := strokePalette[mrand.IntN(len(strokePalette))]
+		drawCurve(img, from, to, bend(from, to), 6, ink)
+		drawArrowhead(img, arrow, ink)
+	}
+
+	for i := 0; i < ImageWidth*KeyImageHeight/40; i++ {
+		c := strokePalette[mrand.IntN(len(strokePalette))]
+		img.SetRGBA(mrand.IntN(ImageWidth), mrand.IntN(KeyImageHeight), c)
+	}
+
+	return img
+}
+
+// =============================================================================
+// HELPERS
+// =============================================================================
+
+// randomIndex returns a uniform value in [0, n) for n <= 256
+func randomIndex(n int) int {
+	limit := 256 - 256%n
+	b := make([]byte, 1)
+	for {
+		rand.Read(b)
+		if int(b[0]) < limit {
+			return int(b[0]) % n
+		}
+	}
+}
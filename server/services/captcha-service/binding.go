@@ -0,0 +1,242 @@
+package captchaservice
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"katanaid/models"
+	"katanaid/util"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// IP binding modes, selected with CAPTCHA_BIND_IP
+const (
+	BindIPOff    = "off"
+	BindIPExact  = "exact"
+	BindIPPrefix = "prefix" // /24 for IPv4, /64 for IPv6
+)
+
+var (
+	ErrTokenInvalid        = errors.New("invalid or expired token")
+	ErrIPMismatch          = errors.New("token was issued to a different IP")
+	ErrFingerprintMismatch = errors.New("token was issued to a different device")
+	ErrActionMismatch      = errors.New("token was issued for a different action")
+	ErrIPUnbound           = errors.New("token is not bound to an IP")
+	ErrTokenRedeemed       = errors.New("token already redeemed")
+	ErrClientIPUnknown     = errors.New("client IP could not be determined")
+	errInvalidAction       = errors.New("invalid action")
+)
+
+var actionRegex = regexp.MustCompile(`^[a-z0-9_/-]{1,64}$`)
+
+// TokenBinding ties a challenge, and the token minted from it, to the client
+// that solved it. Empty fields are not bound
+type TokenBinding struct {
+	IP            string // exact address or CIDR prefix
+	FingerprintID string // fingerprint_id from the trust service
+	Action        string // e.g. "signup", becomes the token audience
+}
+
+// =============================================================================
+// REQ / RES TYPES
+// =============================================================================
+
+type RedeemRequest struct {
+	Token         string `json:"token"`
+	Action        string `json:"action"`
+	RemoteIP      string `json:"remote_ip"` // end-user IP when redeemed server-to-server
+	FingerprintID string `json:"fingerprint_id"`
+}
+
+type RedeemResponse struct {
+	Valid  bool   `json:"valid"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// =============================================================================
+// HANDLERS
+// =============================================================================
+
+// RedeemToken checks a captcha token against the client presenting it and
+// spends it, so each token is accepted once
+func RedeemToken(w http.ResponseWriter, r *http.Request) {
+	var req RedeemRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		util.WriteJSON(w, http.StatusBadRequest, models.ErrorResponse{Error: "Invalid request"})
+		return
+	}
+
+	if req.Token == "" {
+		util.WriteJSON(w, http.StatusBadRequest, models.ErrorResponse{Error: "Token required"})
+		return
+	}
+
+	remoteIP := strings.TrimSpace(req.RemoteIP)
+	if remoteIP == "" {
+		remoteIP = util.ClientIP(r)
+	}
+
+	sessionID, expiresAt, err := ValidateToken(req.Token, TokenBinding{
+		IP:            remoteIP,
+		FingerprintID: normalizeFingerprintID(req.FingerprintID),
+		Action:        strings.ToLower(strings.TrimSpace(req.Action)),
+	})
+	if err != nil {
+		util.WriteJSON(w, http.StatusOK, RedeemResponse{Valid: false, Reason: err.Error()})
+		return
+	}
+
+	// Bindings are checked first so a mismatched attempt can't burn the token
+	err = store.Redeem(r.Context(), sessionID, expiresAt)
+	if errors.Is(err, ErrTokenRedeemed) {
+		util.WriteJSON(w, http.StatusOK, RedeemResponse{Valid: false, Reason: err.Error()})
+		return
+	}
+	if err != nil {
+		log.Print("Error redeeming captcha token:", err)
+		util.WriteJSON(w, http.StatusInternalServerError, models.ErrorResponse{Error: "Redemption failed"})
+		return
+	}
+
+	util.WriteJSON(w, http.StatusOK, RedeemResponse{Valid: true})
+}
+
+// ValidateToken verifies a captcha_verified token and every binding it
+// carries against what the redeeming client presents, and returns the session
+// the token was minted from. It doesn't spend the token
+func ValidateToken(tokenString string, presented TokenBinding) (sessionID string, expiresAt time.Time, err error) {
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, jwt.ErrSignatureInvalid
+		}
+		return []byte(os.Getenv("JWT_SECRET")), nil
+	})
+	if err != nil || !token.Valid {
+		return "", time.Time{}, ErrTokenInvalid
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || claims["type"] != "captcha_verified" {
+		return "", time.Time{}, ErrTokenInvalid
+	}
+	sessionID, _ = claims["session_id"].(string)
+	expiry, err := claims.GetExpirationTime()
+	if sessionID == "" || err != nil || expiry == nil {
+		return "", time.Time{}, ErrTokenInvalid
+	}
+
+	bound := TokenBinding{}
+	bound.IP, _ = claims["ip"].(string)
+	bound.FingerprintID, _ = claims["fp"].(string)
+	if audience, err := claims.GetAudience(); err == nil && len(audience) > 0 {
+		bound.Action = audience[0]
+	}
+
+	// Tokens minted without an IP can't satisfy a deployment that binds them
+	if bound.IP == "" && ipBindingMode() != BindIPOff {
+		return "", time.Time{}, ErrIPUnbound
+	}
+
+	if err := checkBinding(bound, presented); err != nil {
+		return "", time.Time{}, err
+	}
+	return sessionID, expiry.Time, nil
+}
+
+// =============================================================================
+// HELPERS
+// =============================================================================
+
+// bindingFor builds the binding for a new challenge
+func bindingFor(r *http.Request, req CreateChallengeRequest) (TokenBinding, error) {
+	binding := TokenBinding{FingerprintID: normalizeFingerprintID(req.FingerprintID)}
+
+	if action := strings.ToLower(strings.TrimSpace(req.Action)); action != "" {
+		if !actionRegex.MatchString(action) {
+			return TokenBinding{}, errInvalidAction
+		}
+		binding.Action = action
+	}
+
+	// A client whose address can't be parsed can't be bound, so it gets no
+	// challenge rather than an unbound one
+	switch ipBindingMode() {
+	case BindIPExact:
+		ip := util.ClientIP(r)
+		if net.ParseIP(ip) == nil {
+			return TokenBinding{}, ErrClientIPUnknown
+		}
+		binding.IP = ip
+	case BindIPPrefix:
+		binding.IP = util.IPPrefix(util.ClientIP(r))
+		if binding.IP == "" {
+			return TokenBinding{}, ErrClientIPUnknown
+		}
+	}
+
+	return binding, nil
+}
+
+// ipBindingMode is CAPTCHA_BIND_IP, off when unset
+func ipBindingMode() string {
+	switch mode := os.Getenv("CAPTCHA_BIND_IP"); mode {
+	case BindIPExact, BindIPPrefix:
+		return mode
+	default:
+		return BindIPOff
+	}
+}
+
+// checkBinding compares what a challenge or token was bound to with what the
+// client presents. IP and fingerprint are only enforced when bound; actions
+// must always agree so an unscoped token can't be spent on a scoped action
+func checkBinding(bound, presented TokenBinding) error {
+	if bound.IP != "" && !ipMatchesBinding(presented.IP, bound.IP) {
+		return ErrIPMismatch
+	}
+	if bound.FingerprintID != "" && bound.FingerprintID != presented.FingerprintID {
+		return ErrFingerprintMismatch
+	}
+	if bound.Action != presented.Action {
+		return ErrActionMismatch
+	}
+	return nil
+}
+
+// bindingFailure maps a binding error to the reason stored on the session
+func bindingFailure(err error) string {
+	switch {
+	case errors.Is(err, ErrIPMismatch):
+		return "ip_mismatch"
+	case errors.Is(err, ErrFingerprintMismatch):
+		return "fingerprint_mismatch"
+	default:
+		return "action_mismatch"
+	}
+}
+
+func ipMatchesBinding(ip, binding string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+
+	if strings.Contains(binding, "/") {
+		_, network, err := net.ParseCIDR(binding)
+		return err == nil && network.Contains(parsed)
+	}
+
+	return parsed.Equal(net.ParseIP(binding))
+}
+
+func normalizeFingerprintID(id string) string {
+	return strings.ToLower(strings.TrimSpace(id))
+}
@@ -1,17 +1,18 @@
 package captchaservice
 
 import (
-	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"io"
 	"log"
 	"math"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
-	"katanaid/database"
 	"katanaid/models"
 	"katanaid/util"
 
@@ -24,6 +25,16 @@ import (
 
 type ChallengeType string
 
+// ChallengeMode selects the family of challenge issued to the client
+type ChallengeMode string
+
+const (
+	ModeSlash    ChallengeMode = "slash"    // Canvas gesture
+	ModeKeyboard ChallengeMode = "keyboard" // Arrow-key sequence
+	ModeAudio    ChallengeMode = "audio"    // Counted beeps for digits
+	ModeImage    ChallengeMode = "image"    // Server-rendered puzzle
+)
+
 const (
 	SlashDownLeft     ChallengeType = "slash_down_left"     // ↘ Katana slash
 	SlashDownRight    ChallengeType = "slash_down_right"    // ↙ Reverse katana
@@ -34,13 +45,15 @@ const (
 )
 
 const (
-	SessionExpiry      = 2 * time.Minute
-	CaptchaTokenExpiry = 5 * time.Minute
-	AngleTolerance     = 35.0 // degrees
-	MinDurationMs      = 100
-	MaxDurationMs      = 5000
-	MinPointCount      = 5
-	MinGestureDistance = 50.0 // minimum pixel distance for valid gesture
+	SessionExpiry           = 2 * time.Minute
+	AccessibleSessionExpiry = 5 * time.Minute // screen reader users need more time
+	CaptchaTokenExpiry      = 5 * time.Minute
+	AngleTolerance          = 35.0 // degrees
+	MinDurationMs           = 100
+	MaxDurationMs           = 5000
+	MinPointCount           = 5
+	MinGestureDistance      = 50.0 // minimum pixel distance for valid gesture
+	MaxVerifyAttempts       = 3    // failed verifies allowed before the session is burned
 )
 
 // ChallengeConfig holds the configuration for each challenge type
@@ -113,13 +126,24 @@ var challengeTypes = []ChallengeType{
 // REQ / RES TYPES
 // =============================================================================
 
+type CreateChallengeRequest struct {
+	Mode          string `json:"mode"`
+	Action        string `json:"action"`         // optional, bound into the token audience
+	FingerprintID string `json:"fingerprint_id"` // optional, from /api/trust/score
+}
+
 type CreateChallengeResponse struct {
-	SessionID   string     `json:"session_id"`
-	Challenge   string     `json:"challenge"`
-	Instruction string     `json:"instruction"`
-	Emoji       string     `json:"emoji"`
-	Hint        HintConfig `json:"hint"`
-	ExpiresIn   int        `json:"expires_in"`
+	SessionID   string      `json:"session_id"`
+	Mode        string      `json:"mode"`
+	Challenge   string      `json:"challenge"`
+	Instruction string      `json:"instruction"`
+	Emoji       string      `json:"emoji"`
+	Hint        *HintConfig `json:"hint,omitempty"`
+	KeyCount    int         `json:"key_count,omitempty"`
+	AudioURL    string      `json:"audio_url,omitempty"`
+	ImageURL    string      `json:"image_url,omitempty"`
+	AltText     string      `json:"alt_text,omitempty"` // accessible name for the image
+	ExpiresIn   int         `json:"expires_in"`
 }
 
 type HintConfig struct {
@@ -135,13 +159,17 @@ type VerifyRequest struct {
 	StartY     float64 `json:"start_y"`
 	EndX       float64 `json:"end_x"`
 	EndY       float64 `json:"end_y"`
-	DurationMs int     `json:"duration_ms"`
+	DurationMs int     `json:"duration_ms"` // gesture modes only
 	PointCount int     `json:"point_count"`
+	Answer     string  `json:"answer,omitempty"` // keyboard and audio modes
+
+	FingerprintID string `json:"fingerprint_id,omitempty"`
 }
 
 type VerifyResponse struct {
-	Success bool   `json:"success"`
-	Token   string `json:"token,omitempty"`
+	Success      bool   `json:"success"`
+	Token        string `json:"token,omitempty"`
+	AttemptsLeft *int   `json:"attempts_left,omitempty"`
 }
 
 // =============================================================================
@@ -150,45 +178,102 @@ type VerifyResponse struct {
 
 // CreateChallenge generates a new CAPTCHA challenge
 func CreateChallenge(w http.ResponseWriter, r *http.Request) {
-	// Generate random session ID
-	sessionID, err := generateSessionID()
-	if err != nil {
-		log.Print("Error generating session ID:", err)
-		util.WriteJSON(w, http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to create challenge"})
+	// Body is optional, an empty request gets the default slash challenge
+	var req CreateChallengeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		util.WriteJSON(w, http.StatusBadRequest, models.ErrorResponse{Error: "Invalid request"})
 		return
 	}
 
-	// Pick random challenge type
-	challengeType := pickRandomChallenge()
-	config := challengeConfigs[challengeType]
-
-	// Store in database
-	expiresAt := time.Now().Add(SessionExpiry)
-	_, err = database.DB.Exec(
-		context.Background(),
-		`INSERT INTO captcha_sessions (session_id, challenge_type, expected_angle, expires_at) 
-		 VALUES ($1, $2, $3, $4)`,
-		sessionID, string(challengeType), int(config.ExpectedAngle), expiresAt,
-	)
+	mode := ChallengeMode(strings.ToLower(strings.TrimSpace(req.Mode)))
+	if mode == "" {
+		mode = ModeSlash
+	}
+
+	binding, err := bindingFor(r, req)
+	if errors.Is(err, ErrClientIPUnknown) {
+		util.WriteJSON(w, http.StatusBadRequest, models.ErrorResponse{Error: "Could not determine client IP"})
+		return
+	}
 	if err != nil {
-		log.Print("Error storing captcha session:", err)
-		util.WriteJSON(w, http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to create challenge"})
+		util.WriteJSON(w, http.StatusBadRequest, models.ErrorResponse{Error: "Invalid action"})
 		return
 	}
 
-	util.WriteJSON(w, http.StatusOK, CreateChallengeResponse{
-		SessionID:   sessionID,
-		Challenge:   string(challengeType),
-		Instruction: config.Instruction,
-		Emoji:       config.Emoji,
-		Hint: HintConfig{
+	session := challengeSession{Mode: mode, Binding: binding}
+	response := CreateChallengeResponse{Mode: string(mode)}
+	expiry := SessionExpiry
+
+	switch mode {
+	case ModeSlash:
+		// Pick random challenge type
+		session.ChallengeType = pickRandomChallenge()
+		config := challengeConfigs[session.ChallengeType]
+		session.ExpectedAngle = int(config.ExpectedAngle)
+
+		response.Instruction = config.Instruction
+		response.Emoji = config.Emoji
+		response.Hint = &HintConfig{
 			StartX: config.StartX,
 			StartY: config.StartY,
 			EndX:   config.EndX,
 			EndY:   config.EndY,
-		},
-		ExpiresIn: int(SessionExpiry.Seconds()),
-	})
+		}
+	case ModeKeyboard:
+		// The sequence is only ever sent as the rendered image
+		keys := generateKeySequence()
+		session.ChallengeType = KeyboardSequence
+		session.ExpectedAnswer = strings.Join(keys, " ")
+		expiry = AccessibleSessionExpiry
+
+		response.Instruction = KeyboardInstruction
+		response.AltText = KeyboardAltText
+		response.Emoji = "⌨️"
+		response.KeyCount = len(keys)
+	case ModeAudio:
+		session.ChallengeType = AudioDigits
+		session.ExpectedAnswer = generateDigits()
+		expiry = AccessibleSessionExpiry
+
+		response.Instruction = AudioInstruction
+		response.Emoji = "🔊"
+	case ModeImage:
+		// Geometry stays server-side, the client only ever sees the PNG
+		geometry := generateGeometry()
+		session.ChallengeType = ImageSlash
+		session.ExpectedAngle = int(math.Round(geometry.angle()))
+		session.ExpectedAnswer = geometry.String()
+
+		response.Instruction = ImageInstruction
+		response.Emoji = "🖼️"
+	default:
+		util.WriteJSON(w, http.StatusBadRequest, models.ErrorResponse{Error: "Unsupported challenge mode"})
+		return
+	}
+
+	session.CreatedAt = time.Now()
+	session.ExpiresAt = session.CreatedAt.Add(expiry)
+
+	// Persist the session (or seal it into the ID in stateless mode)
+	sessionID, err := store.Save(r.Context(), session)
+	if err != nil {
+		log.Print("Error storing captcha session:", err)
+		util.WriteJSON(w, http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to create challenge"})
+		return
+	}
+	countChallenge()
+
+	response.SessionID = sessionID
+	response.Challenge = string(session.ChallengeType)
+	response.ExpiresIn = int(expiry.Seconds())
+	switch mode {
+	case ModeAudio:
+		response.AudioURL = "/api/captcha/audio/" + sessionID
+	case ModeImage, ModeKeyboard:
+		response.ImageURL = "/api/captcha/image/" + sessionID
+	}
+
+	util.WriteJSON(w, http.StatusOK, response)
 }
 
 // VerifyChallenge validates the user's gesture
@@ -205,55 +290,49 @@ func VerifyChallenge(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Fetch session from database
-	var challengeType string
-	var expectedAngle int
-	var expiresAt time.Time
-	var used bool
-
-	err := database.DB.QueryRow(
-		context.Background(),
-		`SELECT challenge_type, expected_angle, expires_at, used 
-		 FROM captcha_sessions WHERE session_id = $1`,
-		req.SessionID,
-	).Scan(&challengeType, &expectedAngle, &expiresAt, &used)
-
+	// Atomically claim the session so concurrent verifies can't both pass
+	session, err := store.Claim(r.Context(), req.SessionID)
 	if err != nil {
-		util.WriteJSON(w, http.StatusBadRequest, models.ErrorResponse{Error: "Invalid session"})
-		return
-	}
-
-	// Check if already used
-	if used {
-		util.WriteJSON(w, http.StatusBadRequest, models.ErrorResponse{Error: "Session already used"})
-		return
-	}
-
-	// Check if expired
-	if time.Now().After(expiresAt) {
-		util.WriteJSON(w, http.StatusBadRequest, models.ErrorResponse{Error: "Session expired"})
+		if message, ok := sessionErrorMessage(err); ok {
+			util.WriteJSON(w, http.StatusBadRequest, models.ErrorResponse{Error: message})
+			return
+		}
+		log.Print("Error claiming captcha session:", err)
+		util.WriteJSON(w, http.StatusInternalServerError, models.ErrorResponse{Error: "Verification failed"})
 		return
 	}
 
-	// Mark as used immediately to prevent replay attacks
-	_, err = database.DB.Exec(
-		context.Background(),
-		`UPDATE captcha_sessions SET used = TRUE WHERE session_id = $1`,
-		req.SessionID,
+	// A bound challenge must be solved by the client it was issued to
+	bindingErr := checkBinding(
+		TokenBinding{IP: session.Binding.IP, FingerprintID: session.Binding.FingerprintID},
+		TokenBinding{IP: util.ClientIP(r), FingerprintID: normalizeFingerprintID(req.FingerprintID)},
 	)
-	if err != nil {
-		log.Print("Error marking session as used:", err)
-	}
 
-	// Validate gesture
-	validationError := validateGesture(req, float64(expectedAngle))
+	// Validate gesture or typed answer depending on the challenge family
+	var validationError string
+	switch {
+	case bindingErr != nil:
+		validationError = bindingFailure(bindingErr)
+	case session.Mode == ModeKeyboard, session.Mode == ModeAudio:
+		validationError = validateAnswer(req, session)
+	case session.Mode == ModeImage:
+		validationError = validateImageGesture(req, session)
+	default:
+		validationError = validateGesture(req, float64(session.ExpectedAngle))
+	}
 	if validationError != "" {
-		util.WriteJSON(w, http.StatusOK, VerifyResponse{Success: false})
+		// Record why it failed and release the session if retries remain
+		if err := store.Fail(r.Context(), session, validationError); err != nil {
+			log.Print("Error recording captcha failure:", err)
+		}
+
+		attemptsLeft := max(MaxVerifyAttempts-session.Attempts, 0)
+		util.WriteJSON(w, http.StatusOK, VerifyResponse{Success: false, AttemptsLeft: &attemptsLeft})
 		return
 	}
 
 	// Generate verification token
-	token, err := generateCaptchaToken(req.SessionID)
+	token, err := generateCaptchaToken(session.ID, session.Binding)
 	if err != nil {
 		log.Print("Error generating captcha token:", err)
 		util.WriteJSON(w, http.StatusInternalServerError, models.ErrorResponse{Error: "Verification failed"})
@@ -341,12 +420,25 @@ func pickRandomChallenge() ChallengeType {
 	return challengeTypes[int(bytes[0])%len(challengeTypes)]
 }
 
-func generateCaptchaToken(sessionID string) (string, error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+func generateCaptchaToken(sessionID string, binding TokenBinding) (string, error) {
+	claims := jwt.MapClaims{
 		"type":       "captcha_verified",
 		"session_id": sessionID,
 		"iat":        time.Now().Unix(),
 		"exp":        time.Now().Add(CaptchaTokenExpiry).Unix(),
-	})
+	}
+
+	// Only include bindings the challenge was created with
+	if binding.IP != "" {
+		claims["ip"] = binding.IP
+	}
+	if binding.FingerprintID != "" {
+		claims["fp"] = binding.FingerprintID
+	}
+	if binding.Action != "" {
+		claims["aud"] = binding.Action
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 	return token.SignedString([]byte(os.Getenv("JWT_SECRET")))
 }
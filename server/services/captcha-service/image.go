@@ -0,0 +1,249 @@
+package captchaservice
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"log"
+	"math"
+	mrand "math/rand/v2"
+	"net/http"
+	"strings"
+
+	"katanaid/models"
+	"katanaid/util"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// =============================================================================
+// CONSTANTS
+// =============================================================================
+
+const ImageSlash ChallengeType = "image_slash" // Trace the marked stroke
+
+const (
+	ImageWidth        = 400
+	ImageHeight       = 280
+	EndpointTolerance = 45.0 // pixels between the gesture and the target ends
+	DistractorCount   = 7
+
+	ImageInstruction = "Slash along the marked stroke, from the dot to the arrow"
+)
+
+// Stroke colors share a hue family so the target can't be picked by color alone
+var strokePalette = []color.RGBA{
+	{249, 115, 22, 255},
+	{234, 88, 12, 255},
+	{251, 146, 60, 255},
+	{168, 85, 247, 255},
+	{126, 34, 206, 255},
+}
+
+// imageGeometry is the target stroke in image pixels. It never leaves the
+// server except as pixels in the rendered PNG
+type imageGeometry struct {
+	StartX, StartY float64
+	EndX, EndY     float64
+}
+
+// =============================================================================
+// HANDLERS
+// =============================================================================
+
+// GetImageChallenge renders the puzzle or key sequence PNG. Each session's
+// image is served once
+func GetImageChallenge(w http.ResponseWriter, r *http.Request) {
+	session, err := store.ServeImage(r.Context(), chi.URLParam(r, "sessionID"))
+	if errors.Is(err, ErrSessionUsed) || errors.Is(err, ErrSessionExpired) {
+		util.WriteJSON(w, http.StatusGone, models.ErrorResponse{Error: "Image no longer available"})
+		return
+	}
+	if err != nil || (session.Mode != ModeImage && session.Mode != ModeKeyboard) {
+		util.WriteJSON(w, http.StatusNotFound, models.ErrorResponse{Error: "Invalid session"})
+		return
+	}
+
+	// Keyboard challenges show their key sequence through the same one-time URL
+	var img *image.RGBA
+	if session.Mode == ModeKeyboard {
+		img = renderKeySequence(strings.Fields(session.ExpectedAnswer))
+	} else {
+		geometry, err := parseGeometry(session.ExpectedAnswer)
+		if err != nil {
+			log.Print("Error reading image geometry:", err)
+			util.WriteJSON(w, http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to render challenge"})
+			return
+		}
+		img = renderPuzzle(geometry)
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		log.Print("Error encoding captcha image:", err)
+		util.WriteJSON(w, http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to render challenge"})
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
+
+// =============================================================================
+// GEOMETRY
+// =============================================================================
+
+// generateGeometry picks one of the slash directions and jitters both ends so
+// no two puzzles share coordinates
+func generateGeometry() imageGeometry {
+	config := challengeConfigs[pickRandomChallenge()]
+
+	jitter := func(base, size float64) float64 {
+		value := base + (mrand.Float64()*0.16 - 0.08)
+		return math.Round(math.Min(math.Max(value, 0.08), 0.92) * size)
+	}
+
+	return imageGeometry{
+		StartX: jitter(config.StartX, ImageWidth),
+		StartY: jitter(config.StartY, ImageHeight),
+		EndX:   jitter(config.EndX, ImageWidth),
+		EndY:   jitter(config.EndY, ImageHeight),
+	}
+}
+
+func (g imageGeometry) angle() float64 {
+	return calculateAngle(g.StartX, g.StartY, g.EndX, g.EndY)
+}
+
+func (g imageGeometry) String() string {
+	return fmt.Sprintf("%d,%d,%d,%d", int(g.StartX), int(g.StartY), int(g.EndX), int(g.EndY))
+}
+
+func parseGeometry(encoded string) (imageGeometry, error) {
+	var g imageGeometry
+	_, err := fmt.Sscanf(encoded, "%f,%f,%f,%f", &g.StartX, &g.StartY, &g.EndX, &g.EndY)
+	return g, err
+}
+
+// validateImageGesture applies the usual gesture checks, then requires both
+// ends of the slash to land near the target stroke
+func validateImageGesture(req VerifyRequest, session challengeSession) string {
+	if !session.ImageServed {
+		return "image_not_served"
+	}
+
+	geometry, err := parseGeometry(session.ExpectedAnswer)
+	if err != nil {
+		return "invalid_session"
+	}
+
+	if reason := validateGesture(req, geometry.angle()); reason != "" {
+		return reason
+	}
+
+	if calculateDistance(req.StartX, req.StartY, geometry.StartX, geometry.StartY) > EndpointTolerance ||
+		calculateDistance(req.EndX, req.EndY, geometry.EndX, geometry.EndY) > EndpointTolerance {
+		return "off_target"
+	}
+
+	return ""
+}
+
+// =============================================================================
+// RENDERING
+// =============================================================================
+
+func renderPuzzle(target imageGeometry) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, ImageWidth, ImageHeight))
+
+	// Soft gradient with per-pixel noise
+	for y := 0; y < ImageHeight; y++ {
+		for x := 0; x < ImageWidth; x++ {
+			shade := 235 - uint8((x+y)*30/(ImageWidth+ImageHeight))
+			n := uint8(mrand.IntN(18))
+			img.SetRGBA(x, y, color.RGBA{shade - n, shade - n/2, shade, 255})
+		}
+	}
+
+	// Distractor strokes, some as thick as the target but without markers
+	for i := 0; i < DistractorCount; i++ {
+		from := randomPoint()
+		to := randomPoint()
+		width := 2.0 + mrand.Float64()*5
+		drawCurve(img, from, to, bend(from, to), width, strokePalette[mrand.IntN(len(strokePalette))])
+	}
+
+	// Target stroke with a start dot and an arrowhead at the end
+	from := [2]float64{target.StartX, target.StartY}
+	to := [2]float64{target.EndX, target.EndY}
+	ink := strokePalette[mrand.IntN(len(strokePalette))]
+	drawCurve(img, from, to, bend(from, to), 6, ink)
+	fillCircle(img, from[0], from[1], 11, ink)
+	fillCircle(img, from[0], from[1], 6, color.RGBA{255, 255, 255, 255})
+	drawArrowhead(img, target, ink)
+
+	// Speckles over everything so strokes aren't clean runs of one color
+	for i := 0; i < ImageWidth*ImageHeight/40; i++ {
+		c := strokePalette[mrand.IntN(len(strokePalette))]
+		img.SetRGBA(mrand.IntN(ImageWidth), mrand.IntN(ImageHeight), c)
+	}
+
+	return img
+}
+
+func randomPoint() [2]float64 {
+	return [2]float64{mrand.Float64() * ImageWidth, mrand.Float64() * ImageHeight}
+}
+
+// bend returns a control point offset sideways from the midpoint
+func bend(from, to [2]float64) [2]float64 {
+	dx, dy := to[0]-from[0], to[1]-from[1]
+	offset := (mrand.Float64()*2 - 1) * 0.15
+	return [2]float64{(from[0]+to[0])/2 - dy*offset, (from[1]+to[1])/2 + dx*offset}
+}
+
+// drawCurve strokes a quadratic Bézier by stamping discs along it
+func drawCurve(img *image.RGBA, from, to, control [2]float64, width float64, c color.RGBA) {
+	length := calculateDistance(from[0], from[1], to[0], to[1])
+	steps := int(length) + 1
+
+	for i := 0; i <= steps; i++ {
+		t := float64(i) / float64(steps)
+		x := (1-t)*(1-t)*from[0] + 2*(1-t)*t*control[0] + t*t*to[0]
+		y := (1-t)*(1-t)*from[1] + 2*(1-t)*t*control[1] + t*t*to[1]
+		fillCircle(img, x, y, width/2, c)
+	}
+}
+
+func drawArrowhead(img *image.RGBA, target imageGeometry, c color.RGBA) {
+	angle := math.Atan2(target.EndY-target.StartY, target.EndX-target.StartX)
+	tip := [2]float64{target.EndX, target.EndY}
+
+	for _, side := range []float64{-math.Pi / 6, math.Pi / 6} {
+		wing := [2]float64{
+			target.EndX - 22*math.Cos(angle+side),
+			target.EndY - 22*math.Sin(angle+side),
+		}
+		drawCurve(img, tip, wing, tip, 6, c)
+	}
+}
+
+func fillCircle(img *image.RGBA, cx, cy, radius float64, c color.RGBA) {
+	bounds := img.Bounds()
+	for y := int(cy - radius); y <= int(cy+radius); y++ {
+		for x := int(cx - radius); x <= int(cx+radius); x++ {
+			if !(image.Point{x, y}.In(bounds)) {
+				continue
+			}
+			dx, dy := float64(x)-cx, float64(y)-cy
+			if dx*dx+dy*dy <= radius*radius {
+				img.SetRGBA(x, y, c)
+			}
+		}
+	}
+}
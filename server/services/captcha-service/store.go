@@ -0,0 +1,594 @@
+package captchaservice
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"katanaid/database"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Session store backends, selected with CAPTCHA_STORE
+const (
+	StoreDatabase  = "database"
+	StoreStateless = "stateless"
+)
+
+var (
+	ErrInvalidSession = errors.New("invalid session")
+	ErrSessionUsed    = errors.New("session already used")
+	ErrSessionExpired = errors.New("session expired")
+)
+
+// challengeSession is everything needed to verify an answer later
+type challengeSession struct {
+	ID             string
+	Mode           ChallengeMode
+	ChallengeType  ChallengeType
+	ExpectedAngle  int
+	ExpectedAnswer string
+	CreatedAt      time.Time // answers are timed from here, not by the client
+	ExpiresAt      time.Time
+	Attempts       int // verifies made so far, including the current one
+	Binding        TokenBinding
+	ImageServed    bool // image and keyboard modes
+}
+
+// sessionStore persists challenges between create and verify
+type sessionStore interface {
+	// Save stores the session and returns the ID handed to the client
+	Save(ctx context.Context, session challengeSession) (string, error)
+	// Claim atomically locks the session for one verify attempt. It stays
+	// used on success; Fail releases it while attempts remain
+	Claim(ctx context.Context, sessionID string) (challengeSession, error)
+	// Fail records a failed attempt and burns the session once exhausted
+	Fail(ctx context.Context, session challengeSession, reason string) error
+	// Peek loads a live session without consuming it
+	Peek(ctx context.Context, sessionID string) (challengeSession, error)
+	// ServeImage loads a live session the first time its image is requested
+	ServeImage(ctx context.Context, sessionID string) (challengeSession, error)
+	// Redeem spends the token minted from the session, failing with
+	// ErrTokenRedeemed after the first time. expiresAt is the token's expiry
+	Redeem(ctx context.Context, sessionID string, expiresAt time.Time) error
+}
+
+var store sessionStore = &dbStore{}
+
+// Init selects the session store from CAPTCHA_STORE (database by default)
+func Init() error {
+	switch backend := os.Getenv("CAPTCHA_STORE"); backend {
+	case "", StoreDatabase:
+		store = &dbStore{}
+	case StoreStateless:
+		secret := os.Getenv("CAPTCHA_SECRET")
+		if secret == "" {
+			secret = os.Getenv("JWT_SECRET")
+		}
+		s, err := newStatelessStore(secret)
+		if err != nil {
+			return err
+		}
+		store = s
+	default:
+		return fmt.Errorf("unknown CAPTCHA_STORE: %s", backend)
+	}
+	return nil
+}
+
+// sessionErrorMessage maps store errors to client messages; ok is false for
+// unexpected (e.g. database) errors
+func sessionErrorMessage(err error) (message string, ok bool) {
+	switch {
+	case errors.Is(err, ErrSessionUsed):
+		return "Session already used", true
+	case errors.Is(err, ErrSessionExpired):
+		return "Session expired", true
+	case errors.Is(err, ErrInvalidSession):
+		return "Invalid session", true
+	default:
+		return "", false
+	}
+}
+
+// =============================================================================
+// DATABASE STORE
+// =============================================================================
+
+// dbStore keeps one captcha_sessions row per challenge
+type dbStore struct{}
+
+func (s *dbStore) Save(ctx context.Context, session challengeSession) (string, error) {
+	sessionID, err := generateSessionID()
+	if err != nil {
+		return "", err
+	}
+
+	_, err = database.DB.Exec(
+		ctx,
+		`INSERT INTO captcha_sessions
+		 (session_id, challenge_type, expected_angle, mode, expected_answer, created_at, expires_at, bound_ip, fingerprint_id, action)
+		 VALUES ($1, $2, $3, $4, NULLIF($5, ''), $6, $7, NULLIF($8, ''), NULLIF($9, ''), NULLIF($10, ''))`,
+		sessionID, string(session.ChallengeType), session.ExpectedAngle,
+		string(session.Mode), session.ExpectedAnswer, session.CreatedAt, session.ExpiresAt,
+		session.Binding.IP, session.Binding.FingerprintID, session.Binding.Action,
+	)
+	if err != nil {
+		return "", err
+	}
+
+	return sessionID, nil
+}
+
+func (s *dbStore) Claim(ctx context.Context, sessionID string) (challengeSession, error) {
+	session := challengeSession{ID: sessionID}
+	var challengeType, mode string
+	var expectedAnswer, boundIP, fingerprintID, action *string
+
+	// Single conditional update: only one verify can flip used for a live session
+	err := database.DB.QueryRow(
+		ctx,
+		`UPDATE captcha_sessions SET used = TRUE, attempts = attempts + 1
+		 WHERE session_id = $1 AND used = FALSE AND expires_at > $2 AND attempts < $3
+		 RETURNING challenge_type, expected_angle, mode, expected_answer, created_at, expires_at, attempts,
+		           bound_ip, fingerprint_id, action, image_served`,
+		sessionID, time.Now(), MaxVerifyAttempts,
+	).Scan(&challengeType, &session.ExpectedAngle, &mode, &expectedAnswer, &session.CreatedAt, &session.ExpiresAt, &session.Attempts,
+		&boundIP, &fingerprintID, &action, &session.ImageServed)
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		// Nothing claimed, look the row up only to report why
+		if _, err := s.Peek(ctx, sessionID); err != nil {
+			return challengeSession{}, err
+		}
+		return challengeSession{}, ErrSessionUsed
+	}
+	if err != nil {
+		return challengeSession{}, err
+	}
+
+	session.ChallengeType = ChallengeType(challengeType)
+	session.Mode = ChallengeMode(mode)
+	if expectedAnswer != nil {
+		session.ExpectedAnswer = *expectedAnswer
+	}
+	session.Binding = TokenBinding{IP: deref(boundIP), FingerprintID: deref(fingerprintID), Action: deref(action)}
+
+	return session, nil
+}
+
+func (s *dbStore) Fail(ctx context.Context, session challengeSession, reason string) error {
+	_, err := database.DB.Exec(
+		ctx,
+		`UPDATE captcha_sessions
+		 SET used = attempts >= $3, last_failure = $2, failure_reasons = array_append(failure_reasons, $2)
+		 WHERE session_id = $1`,
+		session.ID, reason, MaxVerifyAttempts,
+	)
+	return err
+}
+
+func (s *dbStore) ServeImage(ctx context.Context, sessionID string) (challengeSession, error) {
+	session := challengeSession{ID: sessionID, ImageServed: true}
+	var mode string
+	var expectedAnswer *string
+
+	err := database.DB.QueryRow(
+		ctx,
+		`UPDATE captcha_sessions SET image_served = TRUE
+		 WHERE session_id = $1 AND image_served = FALSE AND used = FALSE AND expires_at > $2
+		 RETURNING mode, expected_answer, expires_at`,
+		sessionID, time.Now(),
+	).Scan(&mode, &expectedAnswer, &session.ExpiresAt)
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		if _, err := s.Peek(ctx, sessionID); err != nil {
+			return challengeSession{}, err
+		}
+		return challengeSession{}, ErrSessionUsed
+	}
+	if err != nil {
+		return challengeSession{}, err
+	}
+
+	session.Mode = ChallengeMode(mode)
+	session.ExpectedAnswer = deref(expectedAnswer)
+
+	return session, nil
+}
+
+func (s *dbStore) Redeem(ctx context.Context, sessionID string, expiresAt time.Time) error {
+	tag, err := database.DB.Exec(
+		ctx,
+		`UPDATE captcha_sessions SET redeemed_at = $2
+		 WHERE session_id = $1 AND redeemed_at IS NULL`,
+		sessionID, time.Now(),
+	)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrTokenRedeemed
+	}
+	return nil
+}
+
+func (s *dbStore) Peek(ctx context.Context, sessionID string) (challengeSession, error) {
+	session := challengeSession{ID: sessionID}
+	var challengeType, mode string
+	var expectedAnswer *string
+	var used bool
+
+	err := database.DB.QueryRow(
+		ctx,
+		`SELECT challenge_type, expected_angle, mode, expected_answer, expires_at, used
+		 FROM captcha_sessions WHERE session_id = $1`,
+		sessionID,
+	).Scan(&challengeType, &session.ExpectedAngle, &mode, &expectedAnswer, &session.ExpiresAt, &used)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return challengeSession{}, ErrInvalidSession
+	}
+	if err != nil {
+		return challengeSession{}, err
+	}
+
+	session.ChallengeType = ChallengeType(challengeType)
+	session.Mode = ChallengeMode(mode)
+	if expectedAnswer != nil {
+		session.ExpectedAnswer = *expectedAnswer
+	}
+
+	if used {
+		return challengeSession{}, ErrSessionUsed
+	}
+	if time.Now().After(session.ExpiresAt) {
+		return challengeSession{}, ErrSessionExpired
+	}
+
+	return session, nil
+}
+
+// =============================================================================
+// STATELESS STORE
+// =============================================================================
+
+// sealedSession is the payload encrypted into a stateless session ID
+type sealedSession struct {
+	ID             string `json:"i"`
+	Mode           string `json:"m"`
+	ChallengeType  string `json:"t"`
+	ExpectedAngle  int    `json:"a,omitempty"`
+	ExpectedAnswer string `json:"x,omitempty"`
+	CreatedAt      int64  `json:"c"` // unix milliseconds
+	ExpiresAt      int64  `json:"e"`
+	BoundIP        string `json:"ip,omitempty"`
+	FingerprintID  string `json:"fp,omitempty"`
+	Action         string `json:"ac,omitempty"`
+}
+
+// statelessStore seals the challenge into an AES-GCM blob returned as the
+// session ID, so nothing is written on create. Single use is enforced by an
+// in-memory replay cache; with several replicas a blob could be redeemed once
+// per process, so multi-instance deployments should keep the database store
+type statelessStore struct {
+	aead   cipher.AEAD
+	replay *replayCache
+}
+
+func newStatelessStore(secret string) (*statelessStore, error) {
+	if len(secret) < 32 {
+		return nil, errors.New("CAPTCHA_SECRET (or JWT_SECRET) must be at least 32 characters")
+	}
+
+	// Derive a dedicated key so captcha blobs never share key material with JWTs
+	key := sha256.Sum256([]byte("katanaid-captcha-session:" + secret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &statelessStore{aead: aead, replay: newReplayCache()}, nil
+}
+
+func (s *statelessStore) Save(ctx context.Context, session challengeSession) (string, error) {
+	id := make([]byte, replayIDSize)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+
+	payload, err := json.Marshal(sealedSession{
+		ID:             hex.EncodeToString(id),
+		Mode:           string(session.Mode),
+		ChallengeType:  string(session.ChallengeType),
+		ExpectedAngle:  session.ExpectedAngle,
+		ExpectedAnswer: session.ExpectedAnswer,
+		CreatedAt:      session.CreatedAt.UnixMilli(),
+		ExpiresAt:      session.ExpiresAt.Unix(),
+		BoundIP:        session.Binding.IP,
+		FingerprintID:  session.Binding.FingerprintID,
+		Action:         session.Binding.Action,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	sealed := s.aead.Seal(nonce, nonce, payload, nil)
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+func (s *statelessStore) Claim(ctx context.Context, sessionID string) (challengeSession, error) {
+	session, err := s.Peek(ctx, sessionID)
+	if err != nil {
+		return challengeSession{}, err
+	}
+
+	attempts, ok := s.replay.Claim(session.ID, session.ExpiresAt)
+	if !ok {
+		return challengeSession{}, ErrSessionUsed
+	}
+	session.Attempts = attempts
+	session.ImageServed = s.replay.Served(session.ID)
+
+	return session, nil
+}
+
+// Fail releases the session for another attempt. There is no row to keep the
+// failure reason on in stateless mode, so it is dropped
+func (s *statelessStore) Fail(ctx context.Context, session challengeSession, reason string) error {
+	s.replay.Release(session.ID)
+	return nil
+}
+
+func (s *statelessStore) ServeImage(ctx context.Context, sessionID string) (challengeSession, error) {
+	session, err := s.Peek(ctx, sessionID)
+	if err != nil {
+		return challengeSession{}, err
+	}
+
+	if !s.replay.Serve(session.ID, session.ExpiresAt) {
+		return challengeSession{}, ErrSessionUsed
+	}
+	session.ImageServed = true
+
+	return session, nil
+}
+
+func (s *statelessStore) Redeem(ctx context.Context, sessionID string, expiresAt time.Time) error {
+	if !s.replay.Redeem(sessionID, expiresAt) {
+		return ErrTokenRedeemed
+	}
+	return nil
+}
+
+func (s *statelessStore) Peek(ctx context.Context, sessionID string) (challengeSession, error) {
+	sealed, err := base64.RawURLEncoding.DecodeString(sessionID)
+	if err != nil || len(sealed) < s.aead.NonceSize() {
+		return challengeSession{}, ErrInvalidSession
+	}
+
+	nonce, ciphertext := sealed[:s.aead.NonceSize()], sealed[s.aead.NonceSize():]
+	payload, err := s.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return challengeSession{}, ErrInvalidSession
+	}
+
+	var blob sealedSession
+	if err := json.Unmarshal(payload, &blob); err != nil {
+		return challengeSession{}, ErrInvalidSession
+	}
+
+	session := challengeSession{
+		ID:             blob.ID,
+		Mode:           ChallengeMode(blob.Mode),
+		ChallengeType:  ChallengeType(blob.ChallengeType),
+		ExpectedAngle:  blob.ExpectedAngle,
+		ExpectedAnswer: blob.ExpectedAnswer,
+		CreatedAt:      time.UnixMilli(blob.CreatedAt),
+		ExpiresAt:      time.Unix(blob.ExpiresAt, 0),
+		Binding:        TokenBinding{IP: blob.BoundIP, FingerprintID: blob.FingerprintID, Action: blob.Action},
+	}
+
+	if time.Now().After(session.ExpiresAt) {
+		return challengeSession{}, ErrSessionExpired
+	}
+	if s.replay.Seen(session.ID) {
+		return challengeSession{}, ErrSessionUsed
+	}
+
+	return session, nil
+}
+
+// =============================================================================
+// REPLAY CACHE
+// =============================================================================
+
+const replayIDSize = 16
+
+// replayCache remembers claimed session IDs until their blob would have
+// expired anyway, so memory is bounded by the create rate times SessionExpiry
+type replayCache struct {
+	mu   sync.Mutex
+	used map[[replayIDSize]byte]*replayEntry
+}
+
+type replayEntry struct {
+	expiresAt int64
+	attempts  int
+	locked    bool // claimed by an in-flight verify, or burned
+	served    bool // image already rendered for this session
+	redeemed  bool // token minted from the session already spent
+}
+
+func newReplayCache() *replayCache {
+	c := &replayCache{used: make(map[[replayIDSize]byte]*replayEntry)}
+	go c.cleanup()
+	return c
+}
+
+// Claim locks the ID for one attempt and returns the attempt number
+func (c *replayCache) Claim(id string, expiresAt time.Time) (int, bool) {
+	key, ok := replayKey(id)
+	if !ok {
+		return 0, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, seen := c.used[key]
+	if !seen {
+		entry = &replayEntry{expiresAt: expiresAt.Unix()}
+		c.used[key] = entry
+	}
+	if entry.locked || entry.attempts >= MaxVerifyAttempts {
+		return 0, false
+	}
+
+	entry.attempts++
+	entry.locked = true
+	return entry.attempts, true
+}
+
+// Serve marks the ID's image as rendered and reports whether it was the first time
+func (c *replayCache) Serve(id string, expiresAt time.Time) bool {
+	key, ok := replayKey(id)
+	if !ok {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, seen := c.used[key]
+	if !seen {
+		entry = &replayEntry{expiresAt: expiresAt.Unix()}
+		c.used[key] = entry
+	}
+	if entry.served {
+		return false
+	}
+
+	entry.served = true
+	return true
+}
+
+func (c *replayCache) Served(id string) bool {
+	key, ok := replayKey(id)
+	if !ok {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, seen := c.used[key]
+	return seen && entry.served
+}
+
+// Redeem marks the ID's token as spent and reports whether it was the first
+// time. The entry is kept until the token itself expires
+func (c *replayCache) Redeem(id string, expiresAt time.Time) bool {
+	key, ok := replayKey(id)
+	if !ok {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, seen := c.used[key]
+	if !seen {
+		entry = &replayEntry{locked: true}
+		c.used[key] = entry
+	}
+	if entry.redeemed {
+		return false
+	}
+
+	entry.redeemed = true
+	entry.expiresAt = max(entry.expiresAt, expiresAt.Unix())
+	return true
+}
+
+// Release unlocks the ID after a failed attempt unless it is exhausted
+func (c *replayCache) Release(id string) {
+	key, ok := replayKey(id)
+	if !ok {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if entry, seen := c.used[key]; seen {
+		entry.locked = entry.attempts >= MaxVerifyAttempts
+	}
+}
+
+// Seen reports whether the ID is currently unusable
+func (c *replayCache) Seen(id string) bool {
+	key, ok := replayKey(id)
+	if !ok {
+		return true
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, seen := c.used[key]
+	return seen && entry.locked
+}
+
+// cleanup drops expired entries every minute
+func (c *replayCache) cleanup() {
+	ticker := time.NewTicker(1 * time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		now := time.Now().Unix()
+		c.mu.Lock()
+		for key, entry := range c.used {
+			if now > entry.expiresAt {
+				delete(c.used, key)
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+func deref(value *string) string {
+	if value == nil {
+		return ""
+	}
+	return *value
+}
+
+func replayKey(id string) ([replayIDSize]byte, bool) {
+	var key [replayIDSize]byte
+	raw, err := hex.DecodeString(id)
+	if err != nil || len(raw) != replayIDSize {
+		return key, false
+	}
+	copy(key[:], raw)
+	return key, true
+}
@@ -0,0 +1,63 @@
+package captchaservice
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"katanaid/database"
+)
+
+const usageFlushInterval = 1 * time.Minute
+
+// usageCounts holds challenges created since the last flush, by day. Counting
+// here rather than in captcha_sessions keeps usage visible in stateless mode,
+// and batching keeps create from writing a row per challenge
+var (
+	usageMu     sync.Mutex
+	usageCounts = map[time.Time]int{}
+)
+
+// countChallenge records one created challenge
+func countChallenge() {
+	now := time.Now().UTC()
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+
+	usageMu.Lock()
+	usageCounts[day]++
+	usageMu.Unlock()
+}
+
+// StartUsageFlush periodically adds the counted challenges to captcha_usage
+func StartUsageFlush() {
+	go func() {
+		for {
+			time.Sleep(usageFlushInterval)
+			flushUsage(context.Background())
+		}
+	}()
+}
+
+func flushUsage(ctx context.Context) {
+	usageMu.Lock()
+	counts := usageCounts
+	usageCounts = map[time.Time]int{}
+	usageMu.Unlock()
+
+	for day, count := range counts {
+		_, err := database.DB.Exec(
+			ctx,
+			`INSERT INTO captcha_usage (day, challenges) VALUES ($1, $2)
+			ON CONFLICT (day) DO UPDATE SET challenges = captcha_usage.challenges + EXCLUDED.challenges`,
+			day, count,
+		)
+		if err != nil {
+			// Keep the count for the next flush
+			log.Print("Error recording captcha usage:", err)
+			usageMu.Lock()
+			usageCounts[day] += count
+			usageMu.Unlock()
+		}
+	}
+}
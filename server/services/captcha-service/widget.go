@@ -0,0 +1,37 @@
+package captchaservice
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+	"strings"
+)
+
+// WidgetVersion is the current embeddable widget release, served under /widget/v1/
+const WidgetVersion = "1.0.0"
+
+//go:embed widget
+var widgetFiles embed.FS
+
+// WidgetHandler serves the embeddable JavaScript widget and stylesheet.
+// Mount it under /widget/
+func WidgetHandler() http.Handler {
+	files, err := fs.Sub(widgetFiles, "widget")
+	if err != nil {
+		panic(err)
+	}
+	fileServer := http.StripPrefix("/widget/", http.FileServer(http.FS(files)))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// No directory listings
+		if strings.HasSuffix(r.URL.Path, "/") {
+			http.NotFound(w, r)
+			return
+		}
+
+		// Paths are versioned, so caching for an hour only delays patch releases
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+		w.Header().Set("X-Widget-Version", WidgetVersion)
+		fileServer.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,547 @@
+/*!
+ * KatanaID CAPTCHA widget v1
+ *
+ * <script src="https://api.example.com/widget/v1/katana-captcha.js" async></script>
+ * <div class="katana-captcha" data-action="signup" data-callback="onCaptcha"></div>
+ *
+ * Or render manually:
+ *   KatanaCaptcha.render(element, { action: "signup", onVerified: fn })
+ */
+(function (window, document) {
+  "use strict";
+
+  if (window.KatanaCaptcha) return;
+
+  // ===========================================================================
+  // CONSTANTS
+  // ===========================================================================
+
+  var VERSION = "1.0.0";
+  var DEFAULT_WIDTH = 400;
+  var DEFAULT_HEIGHT = 280;
+  var TOKEN_LIFETIME_MS = 5 * 60 * 1000; // matches CaptchaTokenExpiry
+  var NEXT_MODE = { slash: "keyboard", image: "keyboard", keyboard: "audio", audio: null };
+  var SWITCH_LABELS = {
+    keyboard: "Keyboard challenge (no mouse)",
+    audio: "Audio challenge (screen readers)",
+    visual: "Visual challenge",
+  };
+  var ARROW_KEYS = {
+    ArrowUp: "up",
+    ArrowDown: "down",
+    ArrowLeft: "left",
+    ArrowRight: "right",
+  };
+
+  var script = document.currentScript;
+  var scriptUrl = script ? new URL(script.src, window.location.href) : null;
+  var scriptOrigin = scriptUrl ? scriptUrl.origin : "";
+
+  // ===========================================================================
+  // HELPERS
+  // ===========================================================================
+
+  function el(tag, className, text) {
+    var node = document.createElement(tag);
+    if (className) node.className = className;
+    if (text) node.textContent = text;
+    return node;
+  }
+
+  // Pull in the stylesheet next to this script unless the page already has it
+  function injectStyles() {
+    if (!scriptUrl || document.querySelector("link[data-katana-captcha]")) return;
+    var link = el("link");
+    link.rel = "stylesheet";
+    link.href = scriptUrl.href.replace(/\.js(\?.*)?$/, ".css");
+    link.setAttribute("data-katana-captcha", "");
+    document.head.appendChild(link);
+  }
+
+  function resolveCallback(value) {
+    if (typeof value === "function") return value;
+    if (typeof value === "string" && typeof window[value] === "function") {
+      return window[value];
+    }
+    return null;
+  }
+
+  function request(baseUrl, path, body) {
+    return fetch(baseUrl + path, {
+      method: "POST",
+      headers: { "Content-Type": "application/json" },
+      body: JSON.stringify(body || {}),
+    }).then(function (response) {
+      return response.json().then(function (data) {
+        if (!response.ok) throw new Error(data.error || "Request failed");
+        return data;
+      });
+    });
+  }
+
+  // ===========================================================================
+  // WIDGET
+  // ===========================================================================
+
+  function Widget(container, options) {
+    this.container = container;
+    this.options = options;
+    this.baseUrl = (options.baseUrl || scriptOrigin).replace(/\/$/, "");
+    this.mode = options.mode || "slash";
+    this.visualMode = NEXT_MODE[this.mode] === "keyboard" ? this.mode : "slash";
+    this.challenge = null;
+    this.points = [];
+    this.keys = [];
+    this.expiryTimer = null;
+
+    this.onVerified = resolveCallback(options.onVerified);
+    this.onError = resolveCallback(options.onError);
+    this.onExpired = resolveCallback(options.onExpired);
+
+    this.build();
+    this.load();
+  }
+
+  Widget.prototype.build = function () {
+    var options = this.options;
+
+    this.root = el("div", "kc-widget");
+    if (options.theme === "dark") this.root.classList.add("kc-theme-dark");
+    if (options.theme && typeof options.theme === "object") {
+      for (var name in options.theme) {
+        this.root.style.setProperty("--kc-" + name, options.theme[name]);
+      }
+    }
+
+    this.header = el("div", "kc-header");
+    this.emoji = el("span", "kc-emoji", "⚔️");
+    this.emoji.setAttribute("aria-hidden", "true");
+    this.instruction = el("span", "kc-instruction", "Loading challenge...");
+    this.instruction.setAttribute("aria-live", "polite");
+    this.header.appendChild(this.emoji);
+    this.header.appendChild(this.instruction);
+
+    this.stage = el("div", "kc-stage");
+
+    this.footer = el("div", "kc-footer");
+    this.retry = el("button", "kc-button", "New challenge");
+    this.retry.type = "button";
+    this.retry.hidden = true;
+    this.retry.addEventListener("click", this.load.bind(this));
+
+    this.switcher = el("button", "kc-link");
+    this.switcher.type = "button";
+    this.switcher.addEventListener("click", this.toggleAccessible.bind(this));
+
+    // Screen-reader users go straight to audio rather than through keyboard
+    // mode, whose sequence is only a picture
+    this.audioSwitch = el("button", "kc-link", SWITCH_LABELS.audio);
+    this.audioSwitch.type = "button";
+    this.audioSwitch.addEventListener("click", this.switchToAudio.bind(this));
+
+    this.footer.appendChild(this.retry);
+    this.footer.appendChild(this.switcher);
+    this.footer.appendChild(this.audioSwitch);
+
+    this.root.appendChild(this.header);
+    this.root.appendChild(this.stage);
+    this.root.appendChild(this.footer);
+    this.container.appendChild(this.root);
+
+    // Hidden field so plain form posts carry the token
+    var form = this.container.closest("form");
+    this.input = el("input");
+    this.input.type = "hidden";
+    this.input.name = options.inputName || "katana-captcha-token";
+    (form || this.container).appendChild(this.input);
+  };
+
+  // Cycles visual -> keyboard -> audio -> visual
+  Widget.prototype.toggleAccessible = function () {
+    this.mode = NEXT_MODE[this.mode] || this.visualMode;
+    this.load();
+  };
+
+  Widget.prototype.switchToAudio = function () {
+    this.mode = "audio";
+    this.load();
+  };
+
+  Widget.prototype.setStatus = function (status, text) {
+    this.status = status;
+    this.root.setAttribute("data-status", status);
+    if (text) this.instruction.textContent = text;
+    this.retry.hidden = status !== "failed";
+  };
+
+  Widget.prototype.fail = function (message) {
+    this.setStatus("failed", message);
+    if (this.onError) this.onError(message);
+  };
+
+  Widget.prototype.load = function () {
+    var self = this;
+    this.setToken("");
+    this.setStatus("idle", "Loading challenge...");
+    this.stage.innerHTML = "";
+    this.canvas = null;
+    this.points = [];
+    this.switcher.textContent = SWITCH_LABELS[NEXT_MODE[this.mode] || "visual"];
+    this.audioSwitch.hidden = this.mode === "audio" || NEXT_MODE[this.mode] === "audio";
+
+    request(this.baseUrl, "/api/captcha/create", {
+      mode: this.mode,
+      action: this.options.action,
+      fingerprint_id: this.options.fingerprintId,
+    })
+      .then(function (challenge) {
+        self.challenge = challenge;
+        self.emoji.textContent = challenge.emoji || "⚔️";
+        self.setStatus("ready", challenge.instruction);
+
+        switch (challenge.mode) {
+          case "keyboard":
+            self.renderKeyboard();
+            break;
+          case "audio":
+            self.renderAudio();
+            break;
+          default:
+            self.renderCanvas();
+        }
+      })
+      .catch(function () {
+        self.fail("Failed to load challenge");
+      });
+  };
+
+  // ---------------------------------------------------------------------------
+  // CANVAS (slash and image modes)
+  // ---------------------------------------------------------------------------
+
+  Widget.prototype.renderCanvas = function () {
+    var self = this;
+    var canvas = el("canvas", "kc-canvas");
+    canvas.width = this.options.width || DEFAULT_WIDTH;
+    canvas.height = this.options.height || DEFAULT_HEIGHT;
+    canvas.setAttribute("role", "img");
+    canvas.setAttribute("aria-label", this.challenge.instruction);
+    this.canvas = canvas;
+    this.ctx = canvas.getContext("2d");
+    this.stage.appendChild(canvas);
+
+    if (this.challenge.image_url) {
+      // Image puzzles are rendered at a fixed size; map gestures onto it
+      canvas.width = DEFAULT_WIDTH;
+      canvas.height = DEFAULT_HEIGHT;
+      this.background = new Image();
+      this.background.onload = function () {
+        self.redraw();
+      };
+      this.background.onerror = function () {
+        self.fail("Failed to load challenge image");
+      };
+      this.background.src = this.baseUrl + this.challenge.image_url;
+    } else {
+      this.background = null;
+      this.redraw();
+    }
+
+    canvas.addEventListener("pointerdown", this.handleStart.bind(this));
+    canvas.addEventListener("pointermove", this.handleMove.bind(this));
+    canvas.addEventListener("pointerup", this.handleEnd.bind(this));
+    canvas.addEventListener("pointerleave", this.handleEnd.bind(this));
+  };
+
+  Widget.prototype.canvasPoint = function (event) {
+    var rect = this.canvas.getBoundingClientRect();
+    return {
+      x: (event.clientX - rect.left) * (this.canvas.width / rect.width),
+      y: (event.clientY - rect.top) * (this.canvas.height / rect.height),
+      time: Date.now(),
+    };
+  };
+
+  Widget.prototype.redraw = function () {
+    var ctx = this.ctx;
+    var canvas = this.canvas;
+    ctx.clearRect(0, 0, canvas.width, canvas.height);
+
+    if (this.background) {
+      ctx.drawImage(this.background, 0, 0, canvas.width, canvas.height);
+    } else if (this.challenge.hint) {
+      this.drawHint(this.challenge.hint);
+    }
+
+    for (var i = 1; i < this.points.length; i++) {
+      this.drawSlash(this.points[i - 1], this.points[i]);
+    }
+  };
+
+  Widget.prototype.drawHint = function (hint) {
+    var ctx = this.ctx;
+    var style = window.getComputedStyle(this.root);
+    var color = style.getPropertyValue("--kc-hint").trim() || "rgba(168, 85, 247, 0.4)";
+    var startX = hint.start_x * this.canvas.width;
+    var startY = hint.start_y * this.canvas.height;
+    var endX = hint.end_x * this.canvas.width;
+    var endY = hint.end_y * this.canvas.height;
+
+    ctx.beginPath();
+    ctx.setLineDash([12, 8]);
+    ctx.moveTo(startX, startY);
+    ctx.lineTo(endX, endY);
+    ctx.strokeStyle = color;
+    ctx.lineWidth = 3;
+    ctx.stroke();
+    ctx.setLineDash([]);
+
+    ctx.beginPath();
+    ctx.arc(startX, startY, 14, 0, Math.PI * 2);
+    ctx.fillStyle = color;
+    ctx.fill();
+
+    var angle = Math.atan2(endY - startY, endX - startX);
+    ctx.beginPath();
+    ctx.moveTo(endX, endY);
+    ctx.lineTo(endX - 16 * Math.cos(angle - Math.PI / 6), endY - 16 * Math.sin(angle - Math.PI / 6));
+    ctx.lineTo(endX - 16 * Math.cos(angle + Math.PI / 6), endY - 16 * Math.sin(angle + Math.PI / 6));
+    ctx.closePath();
+    ctx.fill();
+  };
+
+  Widget.prototype.drawSlash = function (from, to) {
+    var ctx = this.ctx;
+    var style = window.getComputedStyle(this.root);
+    ctx.beginPath();
+    ctx.moveTo(from.x, from.y);
+    ctx.lineTo(to.x, to.y);
+    ctx.strokeStyle = style.getPropertyValue("--kc-accent").trim() || "#f97316";
+    ctx.lineWidth = 5;
+    ctx.lineCap = "round";
+    ctx.stroke();
+  };
+
+  Widget.prototype.handleStart = function (event) {
+    if (this.status !== "ready") return;
+    event.preventDefault();
+    this.canvas.setPointerCapture(event.pointerId);
+    this.points = [this.canvasPoint(event)];
+    this.setStatus("drawing", "Release to verify!");
+  };
+
+  Widget.prototype.handleMove = function (event) {
+    if (this.status !== "drawing") return;
+    var point = this.canvasPoint(event);
+    this.drawSlash(this.points[this.points.length - 1], point);
+    this.points.push(point);
+  };
+
+  Widget.prototype.handleEnd = function () {
+    if (this.status !== "drawing") return;
+    var points = this.points;
+    if (points.length < 2) {
+      this.setStatus("ready", this.challenge.instruction);
+      return;
+    }
+
+    var start = points[0];
+    var end = points[points.length - 1];
+    this.verify({
+      start_x: start.x,
+      start_y: start.y,
+      end_x: end.x,
+      end_y: end.y,
+      duration_ms: end.time - start.time,
+      point_count: points.length,
+    });
+  };
+
+  // ---------------------------------------------------------------------------
+  // KEYBOARD MODE
+  // ---------------------------------------------------------------------------
+
+  Widget.prototype.renderKeyboard = function () {
+    var self = this;
+    var pad = el("div", "kc-keypad");
+    pad.tabIndex = 0;
+    pad.setAttribute("role", "application");
+    pad.setAttribute("aria-label", this.challenge.instruction);
+
+    // The sequence only comes as a picture, never in the challenge JSON. Its
+    // alt text sends screen-reader users to the audio challenge
+    var picture = el("img", "kc-keys");
+    picture.alt = this.challenge.alt_text || "";
+    picture.src = this.baseUrl + this.challenge.image_url;
+    picture.onerror = function () {
+      self.fail("Failed to load challenge image");
+    };
+
+    var progress = el("div", "kc-progress", "Focus here and press the arrow keys");
+    pad.appendChild(picture);
+    pad.appendChild(progress);
+    this.stage.appendChild(pad);
+    this.keys = [];
+
+    pad.addEventListener("keydown", function (event) {
+      var key = ARROW_KEYS[event.key];
+      if (!key || self.status !== "ready") return;
+      event.preventDefault();
+
+      self.keys.push(key);
+      progress.textContent = self.keys.length + " of " + self.challenge.key_count + " keys pressed";
+
+      if (self.keys.length === self.challenge.key_count) {
+        self.verify({ answer: self.keys.join(" ") });
+      }
+    });
+
+    pad.focus();
+  };
+
+  // ---------------------------------------------------------------------------
+  // AUDIO MODE
+  // ---------------------------------------------------------------------------
+
+  Widget.prototype.renderAudio = function () {
+    var self = this;
+    var audio = el("audio", "kc-audio");
+    audio.controls = true;
+    audio.preload = "auto";
+    audio.src = this.baseUrl + this.challenge.audio_url;
+
+    var form = el("div", "kc-answer");
+    var input = el("input", "kc-input");
+    input.type = "text";
+    input.inputMode = "numeric";
+    input.autocomplete = "off";
+    input.setAttribute("aria-label", "Digits you heard");
+    var submit = el("button", "kc-button", "Verify");
+    submit.type = "button";
+
+    submit.addEventListener("click", function () {
+      if (self.status !== "ready") return;
+      self.verify({ answer: input.value });
+    });
+    input.addEventListener("keydown", function (event) {
+      if (event.key === "Enter") {
+        event.preventDefault();
+        submit.click();
+      }
+    });
+
+    form.appendChild(input);
+    form.appendChild(submit);
+    this.stage.appendChild(audio);
+    this.stage.appendChild(form);
+  };
+
+  // ---------------------------------------------------------------------------
+  // VERIFY
+  // ---------------------------------------------------------------------------
+
+  Widget.prototype.verify = function (payload) {
+    var self = this;
+    this.setStatus("verifying", "Verifying...");
+
+    payload.session_id = this.challenge.session_id;
+    payload.fingerprint_id = this.options.fingerprintId;
+
+    request(this.baseUrl, "/api/captcha/verify", payload)
+      .then(function (result) {
+        if (result.success && result.token) {
+          self.setStatus("success", "✓ Verified!");
+          self.setToken(result.token);
+          if (self.onVerified) self.onVerified(result.token);
+          return;
+        }
+
+        self.points = [];
+        self.keys = [];
+        if (result.attempts_left > 0) {
+          // Same session stays valid while retries remain
+          self.setStatus("ready", "Miss! Try again");
+          if (self.canvas) self.redraw();
+          if (self.onError) self.onError("Challenge failed");
+        } else {
+          self.fail("Miss! Load a new challenge");
+        }
+      })
+      .catch(function (error) {
+        self.fail(error.message || "Verification error");
+      });
+  };
+
+  Widget.prototype.setToken = function (token) {
+    var self = this;
+    this.input.value = token;
+    clearTimeout(this.expiryTimer);
+
+    if (token) {
+      this.expiryTimer = setTimeout(function () {
+        self.setToken("");
+        self.setStatus("failed", "Verification expired");
+        if (self.onExpired) self.onExpired();
+      }, TOKEN_LIFETIME_MS);
+    }
+  };
+
+  // ---------------------------------------------------------------------------
+  // PUBLIC API
+  // ---------------------------------------------------------------------------
+
+  Widget.prototype.api = function () {
+    var self = this;
+    return {
+      reset: function () {
+        self.load();
+      },
+      getToken: function () {
+        return self.input.value;
+      },
+      remove: function () {
+        clearTimeout(self.expiryTimer);
+        self.root.remove();
+        self.input.remove();
+      },
+    };
+  };
+
+  function render(container, options) {
+    if (typeof container === "string") container = document.querySelector(container);
+    if (!container) throw new Error("KatanaCaptcha: container not found");
+    if (!options || options.injectStyles !== false) injectStyles();
+    return new Widget(container, options || {}).api();
+  }
+
+  function optionsFromDataset(node) {
+    var data = node.dataset;
+    return {
+      baseUrl: data.baseUrl,
+      action: data.action,
+      mode: data.mode,
+      theme: data.theme,
+      inputName: data.inputName,
+      fingerprintId: data.fingerprintId,
+      onVerified: data.callback,
+      onError: data.errorCallback,
+      onExpired: data.expiredCallback,
+    };
+  }
+
+  function autoRender() {
+    var nodes = document.querySelectorAll(".katana-captcha:not([data-kc-rendered])");
+    for (var i = 0; i < nodes.length; i++) {
+      nodes[i].setAttribute("data-kc-rendered", "true");
+      render(nodes[i], optionsFromDataset(nodes[i]));
+    }
+  }
+
+  window.KatanaCaptcha = { version: VERSION, render: render };
+
+  if (document.readyState === "loading") {
+    document.addEventListener("DOMContentLoaded", autoRender);
+  } else {
+    autoRender();
+  }
+})(window, document);
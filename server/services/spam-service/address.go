@@ -0,0 +1,167 @@
+package spamservice
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+)
+
+// RFC 5321 size limits, in octets
+const (
+	maxLocalPartLength = 64
+	maxDomainLength    = 255
+	maxAddressLength   = 254 // the 256 octet path minus its angle brackets
+	maxLabelLength     = 63
+)
+
+var (
+	errMissingAt       = errors.New("missing_at")
+	errAddressTooLong  = errors.New("address_too_long")
+	errLocalPartEmpty  = errors.New("local_part_empty")
+	errLocalPartLength = errors.New("local_part_too_long")
+	errLocalPartSyntax = errors.New("local_part_invalid")
+	errDomainLength    = errors.New("domain_too_long")
+	errDomainSyntax    = errors.New("domain_invalid")
+	errAddressLiteral  = errors.New("address_literal")
+)
+
+// emailAddress is a parsed address. Domain is the IDNA ASCII form used for
+// lookups, UnicodeDomain what a person would read
+type emailAddress struct {
+	LocalPart     string
+	Domain        string
+	UnicodeDomain string
+}
+
+// parseEmailAddress validates an address against RFC 5321/5322 mailbox syntax,
+// with the UTF-8 local parts and IDN domains of RFC 6531. Errors name the
+// reason and are safe to return to callers
+func parseEmailAddress(email string) (emailAddress, error) {
+	at := strings.LastIndexByte(email, '@')
+	if at < 0 {
+		return emailAddress{}, errMissingAt
+	}
+	localPart, domain := email[:at], email[at+1:]
+
+	if err := validateLocalPart(localPart); err != nil {
+		return emailAddress{}, err
+	}
+
+	if strings.HasPrefix(domain, "[") {
+		return emailAddress{}, errAddressLiteral
+	}
+
+	asciiDomain, err := idna.Lookup.ToASCII(domain)
+	if err != nil {
+		return emailAddress{}, errDomainSyntax
+	}
+	if err := validateDomain(asciiDomain); err != nil {
+		return emailAddress{}, err
+	}
+
+	if len(localPart)+1+len(asciiDomain) > maxAddressLength {
+		return emailAddress{}, errAddressTooLong
+	}
+
+	unicodeDomain, err := idna.Lookup.ToUnicode(asciiDomain)
+	if err != nil {
+		unicodeDomain = asciiDomain
+	}
+
+	return emailAddress{LocalPart: localPart, Domain: asciiDomain, UnicodeDomain: unicodeDomain}, nil
+}
+
+// validateLocalPart accepts a dot-atom or a quoted string
+func validateLocalPart(localPart string) error {
+	if localPart == "" {
+		return errLocalPartEmpty
+	}
+	if len(localPart) > maxLocalPartLength {
+		return errLocalPartLength
+	}
+	if !utf8.ValidString(localPart) {
+		return errLocalPartSyntax
+	}
+
+	if strings.HasPrefix(localPart, `"`) {
+		return validateQuotedLocalPart(localPart)
+	}
+
+	if strings.HasPrefix(localPart, ".") || strings.HasSuffix(localPart, ".") || strings.Contains(localPart, "..") {
+		return errLocalPartSyntax
+	}
+	for _, r := range localPart {
+		if r != '.' && !isAtext(r) {
+			return errLocalPartSyntax
+		}
+	}
+	return nil
+}
+
+func validateQuotedLocalPart(localPart string) error {
+	if len(localPart) < 2 || !strings.HasSuffix(localPart, `"`) {
+		return errLocalPartSyntax
+	}
+
+	escaped := false
+	for _, r := range localPart[1 : len(localPart)-1] {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '"' || r < ' ' || r == 0x7f:
+			return errLocalPartSyntax
+		}
+	}
+	if escaped {
+		return errLocalPartSyntax
+	}
+	return nil
+}
+
+// isAtext is RFC 5322 atext, extended with non-ASCII letters and digits
+func isAtext(r rune) bool {
+	if r > unicode.MaxASCII {
+		return unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r)
+	}
+	return r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' ||
+		strings.ContainsRune("!#$%&'*+/=?^_`{|}~-", r)
+}
+
+// validateDomain checks an ASCII domain is a hostname of at least two labels
+// with a non-numeric TLD
+func validateDomain(domain string) error {
+	if len(domain) > maxDomainLength {
+		return errDomainLength
+	}
+
+	labels := strings.Split(domain, ".")
+	if len(labels) < 2 {
+		return errDomainSyntax
+	}
+
+	for _, label := range labels {
+		if label == "" || len(label) > maxLabelLength {
+			return errDomainSyntax
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return errDomainSyntax
+		}
+		for i := 0; i < len(label); i++ {
+			c := label[i]
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+				return errDomainSyntax
+			}
+		}
+	}
+
+	tld := labels[len(labels)-1]
+	if strings.Trim(tld, "0123456789") == "" {
+		return errDomainSyntax
+	}
+	return nil
+}
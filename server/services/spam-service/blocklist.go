@@ -0,0 +1,273 @@
+package spamservice
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"katanaid/util"
+)
+
+//go:embed data/disposable_email_blocklist.conf
+var blocklist embed.FS
+
+const (
+	embeddedBlocklist = "data/disposable_email_blocklist.conf"
+	watchPollEvery    = 30 * time.Second
+)
+
+// domainList is an immutable snapshot of the disposable domains. Reloads build
+// a new one and swap the pointer, so lookups never block
+type domainList struct {
+	domains  map[string]struct{}
+	version  string
+	source   string
+	loadedAt time.Time
+}
+
+var disposableDomains atomic.Pointer[domainList]
+
+// blocklistPath is DISPOSABLE_LIST_PATH, a file or a directory of list files
+var blocklistPath string
+
+func init() {
+	// Embedded list until InitBlocklist swaps in the configured source
+	list, err := loadEmbeddedBlocklist()
+	if err != nil {
+		log.Print("Failed to load disposable email blocklist:", err)
+		return
+	}
+	disposableDomains.Store(list)
+	log.Printf("Loaded %d disposable email domains", len(list.domains))
+}
+
+// InitBlocklist loads DISPOSABLE_LIST_PATH when set and watches it for
+// changes. Without it the embedded list stays in use
+func InitBlocklist() error {
+	blocklistPath = os.Getenv("DISPOSABLE_LIST_PATH")
+	if blocklistPath == "" {
+		return nil
+	}
+
+	if err := ReloadBlocklist(); err != nil {
+		return err
+	}
+
+	go watchPath(blocklistPath, ReloadBlocklist, "disposable email blocklist")
+	return nil
+}
+
+// ReloadBlocklist re-reads the configured source. On error the current list
+// stays active
+func ReloadBlocklist() error {
+	if blocklistPath == "" {
+		return nil
+	}
+
+	list, err := loadBlocklistPath(blocklistPath)
+	if err != nil {
+		return fmt.Errorf("loading %s: %w", blocklistPath, err)
+	}
+
+	disposableDomains.Store(list)
+	log.Printf("Loaded %d disposable email domains from %s (version %s)", len(list.domains), list.source, list.version)
+	return nil
+}
+
+// isDisposableDomain matches the domain and each parent, so
+// foo.mailinator.com is caught by mailinator.com
+func isDisposableDomain(domain string) bool {
+	list := disposableDomains.Load()
+	if list == nil {
+		return false
+	}
+
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	for {
+		if _, ok := list.domains[domain]; ok {
+			return true
+		}
+
+		dot := strings.IndexByte(domain, '.')
+		// Stop before checking a bare TLD
+		if dot < 0 || !strings.Contains(domain[dot+1:], ".") {
+			return false
+		}
+		domain = domain[dot+1:]
+	}
+}
+
+// =============================================================================
+// ADMIN
+// =============================================================================
+
+type BlocklistInfo struct {
+	Version  string `json:"version"`
+	Count    int    `json:"count"`
+	Source   string `json:"source"`
+	LoadedAt string `json:"loaded_at"`
+}
+
+// GetBlocklistInfo reports which disposable list is currently active
+func GetBlocklistInfo(w http.ResponseWriter, r *http.Request) {
+	list := disposableDomains.Load()
+	if list == nil {
+		util.WriteJSON(w, http.StatusOK, BlocklistInfo{})
+		return
+	}
+
+	util.WriteJSON(w, http.StatusOK, BlocklistInfo{
+		Version:  list.version,
+		Count:    len(list.domains),
+		Source:   list.source,
+		LoadedAt: list.loadedAt.UTC().Format(time.RFC3339),
+	})
+}
+
+// =============================================================================
+// LOADING
+// =============================================================================
+
+func loadEmbeddedBlocklist() (*domainList, error) {
+	data, err := blocklist.ReadFile(embeddedBlocklist)
+	if err != nil {
+		return nil, err
+	}
+
+	domains := make(map[string]struct{})
+	parseDomainList(bytes.NewReader(data), domains)
+	return newDomainList(domains, "embedded"), nil
+}
+
+func loadBlocklistPath(path string) (*domainList, error) {
+	files, err := blocklistFiles(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no list files found")
+	}
+
+	domains := make(map[string]struct{})
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		err = parseDomainList(f, domains)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", file, err)
+		}
+	}
+
+	return newDomainList(domains, path), nil
+}
+
+// blocklistFiles returns path itself, or the .conf/.txt files inside it
+func blocklistFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	files := []string{}
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		if entry.Type().IsRegular() && (ext == ".conf" || ext == ".txt") {
+			files = append(files, filepath.Join(path, entry.Name()))
+		}
+	}
+	return files, nil
+}
+
+func parseDomainList(r io.Reader, domains map[string]struct{}) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		domain := strings.TrimSpace(scanner.Text())
+		if domain != "" && !strings.HasPrefix(domain, "#") {
+			domains[strings.ToLower(domain)] = struct{}{}
+		}
+	}
+	return scanner.Err()
+}
+
+// newDomainList versions the list by content so identical lists from
+// different sources report the same version
+func newDomainList(domains map[string]struct{}, source string) *domainList {
+	sorted := make([]string, 0, len(domains))
+	for domain := range domains {
+		sorted = append(sorted, domain)
+	}
+	slices.Sort(sorted)
+
+	hash := sha256.Sum256([]byte(strings.Join(sorted, "\n")))
+	return &domainList{
+		domains:  domains,
+		version:  hex.EncodeToString(hash[:])[:12],
+		source:   source,
+		loadedAt: time.Now(),
+	}
+}
+
+// =============================================================================
+// WATCHER
+// =============================================================================
+
+// watchPath polls file sizes and modification times and calls reload when
+// anything under path changes
+func watchPath(path string, reload func() error, name string) {
+	last := pathStamp(path)
+
+	ticker := time.NewTicker(watchPollEvery)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		stamp := pathStamp(path)
+		if stamp == last {
+			continue
+		}
+		last = stamp
+
+		if err := reload(); err != nil {
+			log.Printf("Error reloading %s: %v", name, err)
+		}
+	}
+}
+
+func pathStamp(path string) string {
+	files, err := blocklistFiles(path)
+	if err != nil {
+		return ""
+	}
+
+	var stamp strings.Builder
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		fmt.Fprintf(&stamp, "%s:%d:%d;", file, info.Size(), info.ModTime().UnixNano())
+	}
+	return stamp.String()
+}
@@ -0,0 +1,171 @@
+package spamservice
+
+import (
+	"context"
+	"log"
+	"strings"
+
+	"katanaid/database"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const canonicalBackfillBatch = 500
+
+// mailboxRules describes how a provider maps addresses onto mailboxes
+type mailboxRules struct {
+	canonicalDomain string // domain every alias domain folds into
+	ignoreDots      bool
+	tagSeparator    byte // starts a sub-address tag, 0 for none
+}
+
+var defaultMailboxRules = mailboxRules{tagSeparator: '+'}
+
+var providerMailboxRules = func() map[string]mailboxRules {
+	rules := map[string]mailboxRules{
+		"gmail.com":      {canonicalDomain: "gmail.com", ignoreDots: true, tagSeparator: '+'},
+		"googlemail.com": {canonicalDomain: "gmail.com", ignoreDots: true, tagSeparator: '+'},
+		"icloud.com":     {canonicalDomain: "icloud.com", tagSeparator: '+'},
+		"me.com":         {canonicalDomain: "icloud.com", tagSeparator: '+'},
+		"mac.com":        {canonicalDomain: "icloud.com", tagSeparator: '+'},
+	}
+
+	// Outlook keeps dots but supports plus tags
+	for _, domain := range []string{
+		"outlook.com", "outlook.fr", "outlook.de", "hotmail.com", "hotmail.co.uk",
+		"hotmail.fr", "hotmail.de", "hotmail.it", "live.com", "live.co.uk", "msn.com",
+	} {
+		rules[domain] = mailboxRules{tagSeparator: '+'}
+	}
+
+	// Yahoo IDs can't contain hyphens; base-keyword is a disposable address
+	// on the base name's mailbox
+	for _, domain := range []string{
+		"yahoo.com", "yahoo.co.uk", "yahoo.co.in", "yahoo.fr", "yahoo.de",
+		"ymail.com", "rocketmail.com",
+	} {
+		rules[domain] = mailboxRules{tagSeparator: '-'}
+	}
+
+	return rules
+}()
+
+// CanonicalEmail maps an address to the mailbox it delivers to, so aliases of
+// one mailbox compare equal. Unknown providers only lose a plus tag
+func CanonicalEmail(email string) string {
+	email = strings.ToLower(strings.TrimSpace(email))
+	at := strings.LastIndexByte(email, '@')
+	if at <= 0 {
+		return email
+	}
+	localPart, domain := email[:at], email[at+1:]
+
+	rules, ok := providerMailboxRules[domain]
+	if !ok {
+		rules = defaultMailboxRules
+	}
+
+	if rules.tagSeparator != 0 {
+		if i := strings.IndexByte(localPart, rules.tagSeparator); i > 0 {
+			localPart = localPart[:i]
+		}
+	}
+	if rules.ignoreDots {
+		localPart = strings.ReplaceAll(localPart, ".", "")
+	}
+	if rules.canonicalDomain != "" {
+		domain = rules.canonicalDomain
+	}
+
+	return localPart + "@" + domain
+}
+
+// CanonicalEmailHash is the stored form of CanonicalEmail
+func CanonicalEmailHash(email string) string {
+	return HashEmail(CanonicalEmail(email))
+}
+
+// checkCanonicalHistory reports other spellings of the same mailbox that have
+// registered or been checked before
+func checkCanonicalHistory(ctx context.Context, email string) (registered bool, seen int) {
+	canonicalHash := CanonicalEmailHash(email)
+
+	err := database.DB.QueryRow(
+		ctx,
+		`SELECT EXISTS(SELECT 1 FROM users WHERE canonical_email_hash = $1 AND email != $2)`,
+		canonicalHash, email,
+	).Scan(&registered)
+	if err != nil {
+		log.Print("Error checking canonical registrations:", err)
+	}
+
+	err = database.DB.QueryRow(
+		ctx,
+		`SELECT COUNT(DISTINCT email_hash) FROM spam_checks
+		WHERE canonical_hash = $1 AND email_hash != $2`,
+		canonicalHash, HashEmail(email),
+	).Scan(&seen)
+	if err != nil {
+		log.Print("Error checking canonical history:", err)
+	}
+
+	return registered, seen
+}
+
+// StartCanonicalBackfill hashes the canonical form of users' emails that were
+// registered before canonical_email_hash existed. New users get it on insert,
+// so this only has work to do once
+func StartCanonicalBackfill() {
+	go func() {
+		filled, err := backfillCanonicalEmailHashes(context.Background())
+		if err != nil {
+			log.Print("Error backfilling canonical email hashes:", err)
+		}
+		if filled > 0 {
+			log.Printf("Backfilled canonical email hashes for %d users", filled)
+		}
+	}()
+}
+
+// backfillCanonicalEmailHashes walks users missing a hash in id order, a
+// batch at a time
+func backfillCanonicalEmailHashes(ctx context.Context) (int, error) {
+	filled, lastID := 0, 0
+	for {
+		rows, err := database.DB.Query(
+			ctx,
+			`SELECT id, email FROM users
+			WHERE canonical_email_hash IS NULL AND id > $1
+			ORDER BY id LIMIT $2`,
+			lastID, canonicalBackfillBatch,
+		)
+		if err != nil {
+			return filled, err
+		}
+
+		batch := &pgx.Batch{}
+		for rows.Next() {
+			var email string
+			if err := rows.Scan(&lastID, &email); err != nil {
+				rows.Close()
+				return filled, err
+			}
+			batch.Queue(
+				`UPDATE users SET canonical_email_hash = $2 WHERE id = $1 AND canonical_email_hash IS NULL`,
+				lastID, CanonicalEmailHash(email),
+			)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return filled, err
+		}
+		if batch.Len() == 0 {
+			return filled, nil
+		}
+
+		if err := database.DB.SendBatch(ctx, batch).Close(); err != nil {
+			return filled, err
+		}
+		filled += batch.Len()
+	}
+}
@@ -0,0 +1,32 @@
+package spamservice
+
+import "testing"
+
+func TestCanonicalEmail(t *testing.T) {
+	tests := []struct {
+		email string
+		want  string
+	}{
+		{"first.last@gmail.com", "firstlast@gmail.com"},
+		{"F.i.R.s.T.last@Gmail.com", "firstlast@gmail.com"},
+		{"first.last+shop@googlemail.com", "firstlast@gmail.com"},
+		{"first.last@outlook.com", "first.last@outlook.com"},
+		{"first.last+news@outlook.com", "first.last@outlook.com"},
+		{"first-shopping@yahoo.com", "first@yahoo.com"},
+		{"first.last+tag@example.com", "first.last@example.com"},
+		{"me@icloud.com", "me@icloud.com"},
+		{"me+x@mac.com", "me@icloud.com"},
+	}
+
+	for _, tt := range tests {
+		if got := CanonicalEmail(tt.email); got != tt.want {
+			t.Errorf("CanonicalEmail(%q) = %q, want %q", tt.email, got, tt.want)
+		}
+	}
+
+	// Dotted and undotted Gmail spellings share the hash registrations are
+	// looked up by
+	if CanonicalEmailHash("first.last@gmail.com") != CanonicalEmailHash("firstlast@googlemail.com") {
+		t.Error("dotted Gmail spellings hash differently")
+	}
+}
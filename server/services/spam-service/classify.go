@@ -0,0 +1,127 @@
+package spamservice
+
+import "strings"
+
+// Domain types reported in EmailCheckResult.DomainType
+const (
+	DomainFree       = "free"
+	DomainDisposable = "disposable"
+	DomainEducation  = "education"
+	DomainGovernment = "government"
+	DomainISP        = "isp"
+	DomainCorporate  = "corporate"
+)
+
+// roleLocalParts are mailboxes that belong to a function rather than a person.
+// Compared without dots, hyphens and underscores
+var roleLocalParts = toSet([]string{
+	"abuse", "accounts", "accounting", "admin", "administrator", "billing",
+	"careers", "contact", "customerservice", "dev", "devnull", "enquiries",
+	"feedback", "finance", "hello", "help", "helpdesk", "hostmaster", "hr",
+	"info", "inquiries", "it", "jobs", "legal", "mail", "mailerdaemon",
+	"marketing", "media", "news", "newsletter", "noc", "noreply",
+	"donotreply", "office", "orders", "postmaster", "press", "privacy",
+	"root", "sales", "security", "service", "support", "sysadmin", "team",
+	"webmaster", "www",
+})
+
+// freeProviders offer mailboxes to anyone, unlike ISPs which bundle them
+// with a subscription
+var freeProviders = toSet([]string{
+	"gmail.com", "googlemail.com", "yahoo.com", "yahoo.co.uk", "yahoo.co.in",
+	"yahoo.fr", "yahoo.de", "ymail.com", "rocketmail.com", "hotmail.com",
+	"hotmail.co.uk", "hotmail.fr", "hotmail.de", "hotmail.it", "outlook.com",
+	"outlook.fr", "outlook.de", "live.com", "live.co.uk", "msn.com",
+	"icloud.com", "me.com", "mac.com", "aol.com", "protonmail.com",
+	"proton.me", "pm.me", "gmx.com", "gmx.de", "gmx.net", "mail.com",
+	"email.com", "zoho.com", "yandex.com", "yandex.ru", "mail.ru",
+	"tutanota.com", "tuta.io", "web.de", "qq.com", "163.com", "126.com",
+	"naver.com", "hey.com", "fastmail.com", "laposte.net", "libero.it",
+	"inbox.com", "rediffmail.com",
+})
+
+var ispProviders = toSet([]string{
+	"comcast.net", "verizon.net", "att.net", "sbcglobal.net", "cox.net",
+	"charter.net", "btinternet.com", "sky.com", "virginmedia.com",
+	"orange.fr", "free.fr", "sfr.fr", "t-online.de", "bigpond.com",
+	"shaw.ca", "rogers.com",
+})
+
+// isRoleAccount ignores sub-address tags and separators, so no-reply+x is
+// caught as noreply
+func isRoleAccount(localPart string) bool {
+	if i := strings.IndexByte(localPart, '+'); i > 0 {
+		localPart = localPart[:i]
+	}
+	localPart = strings.NewReplacer(".", "", "-", "", "_", "").Replace(localPart)
+	_, ok := roleLocalParts[localPart]
+	return ok
+}
+
+func isFreeProvider(domain string) bool {
+	_, ok := freeProviders[domain]
+	return ok
+}
+
+// classifyDomain decides what kind of organisation a domain belongs to
+func classifyDomain(domain string) string {
+	switch {
+	case isFreeProvider(domain):
+		return DomainFree
+	case isDisposableDomain(domain):
+		return DomainDisposable
+	case isEducationDomain(domain):
+		return DomainEducation
+	case isGovernmentDomain(domain):
+		return DomainGovernment
+	}
+	if _, ok := ispProviders[domain]; ok {
+		return DomainISP
+	}
+	return DomainCorporate
+}
+
+// isEducationDomain covers .edu and the academic second levels used by
+// country TLDs (ac.uk, edu.au, ...)
+func isEducationDomain(domain string) bool {
+	labels := strings.Split(domain, ".")
+	if labels[len(labels)-1] == "edu" {
+		return true
+	}
+	if isCountrySecondLevel(labels) {
+		switch labels[len(labels)-2] {
+		case "edu", "ac", "k12":
+			return true
+		}
+	}
+	return false
+}
+
+func isGovernmentDomain(domain string) bool {
+	labels := strings.Split(domain, ".")
+	switch labels[len(labels)-1] {
+	case "gov", "mil":
+		return true
+	}
+	if isCountrySecondLevel(labels) {
+		switch labels[len(labels)-2] {
+		case "gov", "gouv", "govt", "gob", "go", "gc", "mil":
+			return true
+		}
+	}
+	return false
+}
+
+// isCountrySecondLevel is true for names under a ccTLD second level, like
+// ox.ac.uk, where that second level carries meaning
+func isCountrySecondLevel(labels []string) bool {
+	return len(labels) >= 3 && len(labels[len(labels)-1]) == 2
+}
+
+func toSet(values []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(values))
+	for _, value := range values {
+		set[value] = struct{}{}
+	}
+	return set
+}
@@ -0,0 +1,476 @@
+package spamservice
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	defaultDNSTimeout  = 2 * time.Second
+	defaultNegativeTTL = 5 * time.Minute // when the response carries no SOA
+	minCacheTTL        = 30 * time.Second
+	maxCacheTTL        = 1 * time.Hour
+	maxCacheEntries    = 50000
+	maxUDPResponse     = 4096
+)
+
+var (
+	ErrDNSTimeout = errors.New("dns lookup timed out")
+	ErrDNSFailure = errors.New("dns server failure")
+)
+
+// DNSAnswer is the outcome of one query. A name that doesn't exist or has no
+// records of the type is a valid, cacheable answer with no Records
+type DNSAnswer struct {
+	Records  []dnsmessage.Resource
+	NXDomain bool
+}
+
+// DNSResolver answers single-type queries. Swap it with SetResolver to point
+// the checks at a fake server or a stub
+type DNSResolver interface {
+	Lookup(ctx context.Context, name string, qtype dnsmessage.Type) (DNSAnswer, error)
+}
+
+var resolver DNSResolver = NewCachingResolver(systemNameservers(), defaultDNSTimeout)
+
+// InitResolver applies DNS_SERVER (comma separated host:port, tried in order)
+// and DNS_TIMEOUT (a Go duration, for the whole lookup)
+func InitResolver() error {
+	servers := systemNameservers()
+	if value := os.Getenv("DNS_SERVER"); value != "" {
+		servers = nil
+		for _, server := range strings.Split(value, ",") {
+			server = strings.TrimSpace(server)
+			if server == "" {
+				continue
+			}
+			if _, _, err := net.SplitHostPort(server); err != nil {
+				server = net.JoinHostPort(server, "53")
+			}
+			servers = append(servers, server)
+		}
+	}
+
+	timeout := defaultDNSTimeout
+	if value := os.Getenv("DNS_TIMEOUT"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			return fmt.Errorf("invalid DNS_TIMEOUT %q", value)
+		}
+		timeout = parsed
+	}
+
+	resolver = NewCachingResolver(servers, timeout)
+	return nil
+}
+
+// SetResolver replaces the resolver used by email checks
+func SetResolver(r DNSResolver) {
+	resolver = r
+}
+
+// =============================================================================
+// CACHING RESOLVER
+// =============================================================================
+
+// CachingResolver queries nameservers directly so record TTLs are visible, and
+// caches answers, including empty ones, for as long as they allow. Servers are
+// tried in order until one gives a definitive answer
+type CachingResolver struct {
+	servers []string
+	timeout time.Duration
+	dialer  net.Dialer
+
+	mu       sync.Mutex
+	cache    map[dnsCacheKey]dnsCacheEntry
+	inflight map[dnsCacheKey]*dnsCall
+}
+
+// dnsCall lets concurrent misses for the same question share one query
+type dnsCall struct {
+	done   chan struct{}
+	answer DNSAnswer
+	err    error
+}
+
+type dnsCacheKey struct {
+	name  string
+	qtype dnsmessage.Type
+}
+
+type dnsCacheEntry struct {
+	answer    DNSAnswer
+	expiresAt time.Time
+}
+
+func NewCachingResolver(servers []string, timeout time.Duration) *CachingResolver {
+	return &CachingResolver{
+		servers:  servers,
+		timeout:  timeout,
+		cache:    make(map[dnsCacheKey]dnsCacheEntry),
+		inflight: make(map[dnsCacheKey]*dnsCall),
+	}
+}
+
+func (r *CachingResolver) Lookup(ctx context.Context, name string, qtype dnsmessage.Type) (DNSAnswer, error) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	key := dnsCacheKey{name: name, qtype: qtype}
+
+	r.mu.Lock()
+	if entry, ok := r.cache[key]; ok && time.Now().Before(entry.expiresAt) {
+		r.mu.Unlock()
+		return entry.answer, nil
+	}
+	if call, ok := r.inflight[key]; ok {
+		r.mu.Unlock()
+		select {
+		case <-call.done:
+			return call.answer, call.err
+		case <-ctx.Done():
+			return DNSAnswer{}, ErrDNSTimeout
+		}
+	}
+	call := &dnsCall{done: make(chan struct{})}
+	r.inflight[key] = call
+	r.mu.Unlock()
+
+	// The shared query isn't cut short by whichever caller started it
+	queryCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), r.timeout)
+	defer cancel()
+
+	answer, ttl, err := r.query(queryCtx, name, qtype)
+	if err != nil && (errors.Is(err, context.DeadlineExceeded) || isTimeout(err)) {
+		err = ErrDNSTimeout
+	}
+
+	r.mu.Lock()
+	delete(r.inflight, key)
+	if err == nil {
+		if len(r.cache) >= maxCacheEntries {
+			r.evictExpired()
+		}
+		if len(r.cache) < maxCacheEntries {
+			r.cache[key] = dnsCacheEntry{answer: answer, expiresAt: time.Now().Add(clampTTL(ttl))}
+		}
+	}
+	r.mu.Unlock()
+
+	call.answer, call.err = answer, err
+	close(call.done)
+	return answer, err
+}
+
+// query asks each server in turn until one answers or denies the name. A
+// server that times out, can't be reached or fails the query passes what is
+// left of the time budget on to the next
+func (r *CachingResolver) query(ctx context.Context, name string, qtype dnsmessage.Type) (DNSAnswer, time.Duration, error) {
+	qname, err := dnsmessage.NewName(name + ".")
+	if err != nil {
+		return DNSAnswer{}, 0, err
+	}
+	question := dnsmessage.Question{Name: qname, Type: qtype, Class: dnsmessage.ClassINET}
+
+	err = errors.New("no dns servers configured")
+	for i, server := range r.servers {
+		attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+		if deadline, ok := ctx.Deadline(); ok {
+			share := time.Until(deadline) / time.Duration(len(r.servers)-i)
+			attemptCtx, cancel = context.WithTimeout(ctx, share)
+		}
+
+		var answer DNSAnswer
+		var ttl time.Duration
+		answer, ttl, err = r.queryServer(attemptCtx, server, question)
+		cancel()
+		if err == nil {
+			return answer, ttl, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return DNSAnswer{}, 0, err
+}
+
+// queryServer sends one question over UDP with EDNS0, retrying over TCP when
+// truncated and without EDNS0 when the server rejects it
+func (r *CachingResolver) queryServer(ctx context.Context, server string, question dnsmessage.Question) (DNSAnswer, time.Duration, error) {
+	response, err := r.exchangeMessage(ctx, server, question, true)
+	if err == nil && response.RCode == dnsmessage.RCodeFormatError {
+		response, err = r.exchangeMessage(ctx, server, question, false)
+	}
+	if err != nil {
+		return DNSAnswer{}, 0, err
+	}
+
+	switch response.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return DNSAnswer{NXDomain: true}, negativeTTL(response), nil
+	default:
+		return DNSAnswer{}, 0, fmt.Errorf("%w: %s", ErrDNSFailure, response.RCode)
+	}
+
+	answer := DNSAnswer{}
+	var ttl time.Duration
+	for _, record := range response.Answers {
+		if record.Header.Type != question.Type {
+			continue // CNAMEs followed by the recursive server
+		}
+		answer.Records = append(answer.Records, record)
+		recordTTL := time.Duration(record.Header.TTL) * time.Second
+		if ttl == 0 || recordTTL < ttl {
+			ttl = recordTTL
+		}
+	}
+	if len(answer.Records) == 0 {
+		ttl = negativeTTL(response)
+	}
+
+	return answer, ttl, nil
+}
+
+func (r *CachingResolver) exchangeMessage(ctx context.Context, server string, question dnsmessage.Question, edns bool) (dnsmessage.Message, error) {
+	var idBytes [2]byte
+	if _, err := rand.Read(idBytes[:]); err != nil {
+		return dnsmessage.Message{}, err
+	}
+
+	request := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: binary.BigEndian.Uint16(idBytes[:]), RecursionDesired: true},
+		Questions: []dnsmessage.Question{question},
+	}
+	if edns {
+		// Advertise a large UDP buffer so SPF-sized TXT answers aren't truncated
+		var opt dnsmessage.ResourceHeader
+		if err := opt.SetEDNS0(maxUDPResponse, dnsmessage.RCodeSuccess, false); err != nil {
+			return dnsmessage.Message{}, err
+		}
+		request.Additionals = []dnsmessage.Resource{{Header: opt, Body: &dnsmessage.OPTResource{}}}
+	}
+	packed, err := request.Pack()
+	if err != nil {
+		return dnsmessage.Message{}, err
+	}
+
+	response, err := r.exchange(ctx, "udp", server, packed, request)
+	if err == nil && response.Truncated {
+		response, err = r.exchange(ctx, "tcp", server, packed, request)
+	}
+	return response, err
+}
+
+// exchange sends the packed request and returns the first reply that answers
+// it. Over UDP, packets with another ID or question are dropped and reading
+// goes on until the deadline, so a stray or spoofed packet can't fail the
+// lookup
+func (r *CachingResolver) exchange(ctx context.Context, network, server string, packed []byte, request dnsmessage.Message) (dnsmessage.Message, error) {
+	conn, err := r.dialer.DialContext(ctx, network, server)
+	if err != nil {
+		return dnsmessage.Message{}, err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if network == "udp" {
+		if _, err := conn.Write(packed); err != nil {
+			return dnsmessage.Message{}, err
+		}
+		buf := make([]byte, maxUDPResponse)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return dnsmessage.Message{}, err
+			}
+			var response dnsmessage.Message
+			if response.Unpack(buf[:n]) == nil && answersRequest(response, request) {
+				return response, nil
+			}
+		}
+	}
+
+	// TCP messages carry a two-byte length prefix
+	framed := binary.BigEndian.AppendUint16(nil, uint16(len(packed)))
+	if _, err := conn.Write(append(framed, packed...)); err != nil {
+		return dnsmessage.Message{}, err
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return dnsmessage.Message{}, err
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return dnsmessage.Message{}, err
+	}
+
+	var response dnsmessage.Message
+	if err := response.Unpack(buf); err != nil {
+		return dnsmessage.Message{}, err
+	}
+	if !answersRequest(response, request) {
+		return dnsmessage.Message{}, errors.New("dns response does not match the query")
+	}
+	return response, nil
+}
+
+// answersRequest checks the reply's ID and echoed question
+func answersRequest(response, request dnsmessage.Message) bool {
+	if !response.Response || response.ID != request.ID {
+		return false
+	}
+	if len(response.Questions) == 0 {
+		// Some servers leave the question out of error replies
+		return response.RCode != dnsmessage.RCodeSuccess
+	}
+	q, want := response.Questions[0], request.Questions[0]
+	return q.Type == want.Type && q.Class == want.Class && strings.EqualFold(q.Name.String(), want.Name.String())
+}
+
+// evictExpired drops stale entries. Callers hold r.mu
+func (r *CachingResolver) evictExpired() {
+	now := time.Now()
+	for key, entry := range r.cache {
+		if now.After(entry.expiresAt) {
+			delete(r.cache, key)
+		}
+	}
+}
+
+// =============================================================================
+// LOOKUPS
+// =============================================================================
+
+// lookupMX returns the domain's mail exchangers in order of preference,
+// lowercased without the trailing dot
+func lookupMX(ctx context.Context, domain string) ([]string, error) {
+	answer, err := resolver.Lookup(ctx, domain, dnsmessage.TypeMX)
+	if err != nil {
+		return nil, err
+	}
+
+	records := []*dnsmessage.MXResource{}
+	for _, record := range answer.Records {
+		if mx, ok := record.Body.(*dnsmessage.MXResource); ok {
+			records = append(records, mx)
+		}
+	}
+	slices.SortStableFunc(records, func(a, b *dnsmessage.MXResource) int {
+		return int(a.Pref) - int(b.Pref)
+	})
+
+	hosts := make([]string, 0, len(records))
+	for _, mx := range records {
+		hosts = append(hosts, strings.ToLower(strings.TrimSuffix(mx.MX.String(), ".")))
+	}
+	return hosts, nil
+}
+
+// lookupHostAddrs returns the host's IPv4 and IPv6 addresses. An IP literal
+// is returned as is
+func lookupHostAddrs(ctx context.Context, host string) ([]netip.Addr, error) {
+	if addr, err := netip.ParseAddr(strings.Trim(host, "[]")); err == nil {
+		return []netip.Addr{addr}, nil
+	}
+
+	addrs := []netip.Addr{}
+	var lastErr error
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		answer, err := resolver.Lookup(ctx, host, qtype)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for _, record := range answer.Records {
+			switch body := record.Body.(type) {
+			case *dnsmessage.AResource:
+				addrs = append(addrs, netip.AddrFrom4(body.A))
+			case *dnsmessage.AAAAResource:
+				addrs = append(addrs, netip.AddrFrom16(body.AAAA))
+			}
+		}
+	}
+	if len(addrs) == 0 && lastErr != nil {
+		return nil, lastErr
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no addresses for %s", host)
+	}
+	return addrs, nil
+}
+
+// lookupTXT returns each TXT record with its strings joined
+func lookupTXT(ctx context.Context, name string) ([]string, error) {
+	answer, err := resolver.Lookup(ctx, name, dnsmessage.TypeTXT)
+	if err != nil {
+		return nil, err
+	}
+
+	records := []string{}
+	for _, record := range answer.Records {
+		if txt, ok := record.Body.(*dnsmessage.TXTResource); ok {
+			records = append(records, strings.Join(txt.TXT, ""))
+		}
+	}
+	return records, nil
+}
+
+// =============================================================================
+// HELPERS
+// =============================================================================
+
+// negativeTTL follows RFC 2308: the lesser of the SOA's TTL and minimum field
+func negativeTTL(response dnsmessage.Message) time.Duration {
+	for _, record := range response.Authorities {
+		if soa, ok := record.Body.(*dnsmessage.SOAResource); ok {
+			return time.Duration(min(record.Header.TTL, soa.MinTTL)) * time.Second
+		}
+	}
+	return defaultNegativeTTL
+}
+
+func clampTTL(ttl time.Duration) time.Duration {
+	return min(max(ttl, minCacheTTL), maxCacheTTL)
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// systemNameservers reads the nameservers from /etc/resolv.conf, in order
+func systemNameservers() []string {
+	servers := []string{}
+	f, err := os.Open("/etc/resolv.conf")
+	if err == nil {
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) >= 2 && fields[0] == "nameserver" {
+				servers = append(servers, net.JoinHostPort(fields[1], "53"))
+			}
+		}
+	}
+	if len(servers) == 0 {
+		servers = append(servers, "127.0.0.1:53")
+	}
+	return servers
+}
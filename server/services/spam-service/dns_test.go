@@ -0,0 +1,310 @@
+package spamservice
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeDNSServer answers queries on a local UDP port, and on TCP at the same
+// address for truncated answers
+type fakeDNSServer struct {
+	addr    string
+	udp     net.PacketConn
+	tcp     net.Listener
+	queries atomic.Int32
+
+	// handle builds the reply to a query; tcp says which transport asked
+	handle func(query dnsmessage.Message, tcp bool) dnsmessage.Message
+	// beforeReply, when set, returns raw packets sent ahead of the real reply
+	beforeReply func(query dnsmessage.Message) [][]byte
+}
+
+// startFakeDNSServer listens on a free port and serves with s's handlers
+func startFakeDNSServer(t *testing.T, s *fakeDNSServer) *fakeDNSServer {
+	t.Helper()
+
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcp, err := net.Listen("tcp", udp.LocalAddr().String())
+	if err != nil {
+		udp.Close()
+		t.Skip("tcp port paired with the udp one is taken:", err)
+	}
+
+	s.addr, s.udp, s.tcp = udp.LocalAddr().String(), udp, tcp
+	t.Cleanup(func() {
+		udp.Close()
+		tcp.Close()
+	})
+
+	go s.serveUDP()
+	go s.serveTCP()
+	return s
+}
+
+func newFakeDNSServer(t *testing.T, handle func(query dnsmessage.Message, tcp bool) dnsmessage.Message) *fakeDNSServer {
+	return startFakeDNSServer(t, &fakeDNSServer{handle: handle})
+}
+
+func (s *fakeDNSServer) serveUDP() {
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := s.udp.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		var query dnsmessage.Message
+		if query.Unpack(buf[:n]) != nil {
+			continue
+		}
+		s.queries.Add(1)
+
+		if s.beforeReply != nil {
+			for _, packet := range s.beforeReply(query) {
+				s.udp.WriteTo(packet, from)
+			}
+		}
+		if s.handle == nil {
+			continue // never answers
+		}
+		reply := s.handle(query, false)
+		packed, err := reply.Pack()
+		if err != nil {
+			continue
+		}
+		s.udp.WriteTo(packed, from)
+	}
+}
+
+func (s *fakeDNSServer) serveTCP() {
+	for {
+		conn, err := s.tcp.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			var length [2]byte
+			if _, err := io.ReadFull(conn, length[:]); err != nil {
+				return
+			}
+			buf := make([]byte, binary.BigEndian.Uint16(length[:]))
+			if _, err := io.ReadFull(conn, buf); err != nil {
+				return
+			}
+			var query dnsmessage.Message
+			if query.Unpack(buf) != nil || s.handle == nil {
+				return
+			}
+			s.queries.Add(1)
+			response := s.handle(query, true)
+			packed, err := response.Pack()
+			if err != nil {
+				return
+			}
+			conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(packed))), packed...))
+		}()
+	}
+}
+
+// reply starts a response to the query with the given code
+func reply(query dnsmessage.Message, rcode dnsmessage.RCode) dnsmessage.Message {
+	return dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: query.ID, Response: true, RecursionAvailable: true, RCode: rcode},
+		Questions: query.Questions,
+	}
+}
+
+func mxAnswer(query dnsmessage.Message, hosts ...string) dnsmessage.Message {
+	response := reply(query, dnsmessage.RCodeSuccess)
+	for i, host := range hosts {
+		response.Answers = append(response.Answers, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: query.Questions[0].Name, Type: dnsmessage.TypeMX, Class: dnsmessage.ClassINET, TTL: 300},
+			Body:   &dnsmessage.MXResource{Pref: uint16(10 * (len(hosts) - i)), MX: dnsmessage.MustNewName(host + ".")},
+		})
+	}
+	return response
+}
+
+func hasEDNS(query dnsmessage.Message) bool {
+	for _, record := range query.Additionals {
+		if record.Header.Type == dnsmessage.TypeOPT {
+			return true
+		}
+	}
+	return false
+}
+
+func TestResolverLookupMX(t *testing.T) {
+	server := newFakeDNSServer(t, func(query dnsmessage.Message, tcp bool) dnsmessage.Message {
+		return mxAnswer(query, "mx2.example.com", "mx1.example.com")
+	})
+	SetResolver(NewCachingResolver([]string{server.addr}, time.Second))
+	t.Cleanup(func() { SetResolver(NewCachingResolver(systemNameservers(), defaultDNSTimeout)) })
+
+	hosts, err := lookupMX(context.Background(), "Example.com.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hosts) != 2 || hosts[0] != "mx1.example.com" || hosts[1] != "mx2.example.com" {
+		t.Errorf("hosts = %v, want [mx1.example.com mx2.example.com]", hosts)
+	}
+
+	// Answered from the cache
+	if _, err := lookupMX(context.Background(), "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if got := server.queries.Load(); got != 1 {
+		t.Errorf("server saw %d queries, want 1", got)
+	}
+}
+
+func TestResolverCachesNXDomain(t *testing.T) {
+	server := newFakeDNSServer(t, func(query dnsmessage.Message, tcp bool) dnsmessage.Message {
+		return reply(query, dnsmessage.RCodeNameError)
+	})
+	r := NewCachingResolver([]string{server.addr}, time.Second)
+
+	for i := 0; i < 2; i++ {
+		answer, err := r.Lookup(context.Background(), "missing.example", dnsmessage.TypeMX)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !answer.NXDomain {
+			t.Error("NXDomain = false, want true")
+		}
+	}
+	if got := server.queries.Load(); got != 1 {
+		t.Errorf("server saw %d queries, want 1", got)
+	}
+}
+
+func TestResolverIgnoresStrayPackets(t *testing.T) {
+	server := startFakeDNSServer(t, &fakeDNSServer{
+		handle: func(query dnsmessage.Message, tcp bool) dnsmessage.Message {
+			return mxAnswer(query, "mx.example.com")
+		},
+		beforeReply: strayPackets,
+	})
+	r := NewCachingResolver([]string{server.addr}, time.Second)
+
+	answer, err := r.Lookup(context.Background(), "example.com", dnsmessage.TypeMX)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(answer.Records) != 1 || answer.Records[0].Body.(*dnsmessage.MXResource).MX.String() != "mx.example.com." {
+		t.Errorf("records = %v, want the genuine answer", answer.Records)
+	}
+}
+
+// strayPackets are sent ahead of the genuine reply: junk, a reply with the
+// wrong ID and one for another question
+func strayPackets(query dnsmessage.Message) [][]byte {
+	wrongID := mxAnswer(query, "evil.example.net")
+	wrongID.ID = query.ID + 1
+	wrongQuestion := mxAnswer(query, "evil.example.net")
+	wrongQuestion.Questions = []dnsmessage.Question{{
+		Name: dnsmessage.MustNewName("other.example."), Type: dnsmessage.TypeMX, Class: dnsmessage.ClassINET,
+	}}
+
+	packets := [][]byte{[]byte("garbage")}
+	for _, message := range []dnsmessage.Message{wrongID, wrongQuestion} {
+		packed, _ := message.Pack()
+		packets = append(packets, packed)
+	}
+	return packets
+}
+
+func TestResolverFallsBackToNextServer(t *testing.T) {
+	silent := newFakeDNSServer(t, nil)
+	failing := newFakeDNSServer(t, func(query dnsmessage.Message, tcp bool) dnsmessage.Message {
+		return reply(query, dnsmessage.RCodeServerFailure)
+	})
+	working := newFakeDNSServer(t, func(query dnsmessage.Message, tcp bool) dnsmessage.Message {
+		return mxAnswer(query, "mx.example.com")
+	})
+
+	r := NewCachingResolver([]string{silent.addr, failing.addr, working.addr}, 900*time.Millisecond)
+	answer, err := r.Lookup(context.Background(), "example.com", dnsmessage.TypeMX)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(answer.Records) != 1 {
+		t.Errorf("got %d records, want 1", len(answer.Records))
+	}
+	if silent.queries.Load() != 1 || failing.queries.Load() != 1 || working.queries.Load() != 1 {
+		t.Errorf("queries = %d, %d, %d, want one to each server",
+			silent.queries.Load(), failing.queries.Load(), working.queries.Load())
+	}
+}
+
+func TestResolverTimesOut(t *testing.T) {
+	silent := newFakeDNSServer(t, nil)
+	r := NewCachingResolver([]string{silent.addr}, 100*time.Millisecond)
+
+	_, err := r.Lookup(context.Background(), "example.com", dnsmessage.TypeMX)
+	if !errors.Is(err, ErrDNSTimeout) {
+		t.Errorf("err = %v, want ErrDNSTimeout", err)
+	}
+}
+
+func TestResolverSendsEDNS0AndRetriesTruncatedOverTCP(t *testing.T) {
+	var sawEDNS atomic.Bool
+	server := newFakeDNSServer(t, func(query dnsmessage.Message, tcp bool) dnsmessage.Message {
+		if hasEDNS(query) {
+			sawEDNS.Store(true)
+		}
+		if !tcp {
+			truncated := reply(query, dnsmessage.RCodeSuccess)
+			truncated.Truncated = true
+			return truncated
+		}
+		response := reply(query, dnsmessage.RCodeSuccess)
+		response.Answers = []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: query.Questions[0].Name, Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET, TTL: 300},
+			Body:   &dnsmessage.TXTResource{TXT: []string{"v=spf1 ", "-all"}},
+		}}
+		return response
+	})
+	SetResolver(NewCachingResolver([]string{server.addr}, time.Second))
+	t.Cleanup(func() { SetResolver(NewCachingResolver(systemNameservers(), defaultDNSTimeout)) })
+
+	records, err := lookupTXT(context.Background(), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0] != "v=spf1 -all" {
+		t.Errorf("records = %q, want [\"v=spf1 -all\"]", records)
+	}
+	if !sawEDNS.Load() {
+		t.Error("query carried no EDNS0 OPT record")
+	}
+}
+
+func TestResolverRetriesWithoutEDNS0OnFormErr(t *testing.T) {
+	server := newFakeDNSServer(t, func(query dnsmessage.Message, tcp bool) dnsmessage.Message {
+		if hasEDNS(query) {
+			return reply(query, dnsmessage.RCodeFormatError)
+		}
+		return mxAnswer(query, "mx.example.com")
+	})
+	r := NewCachingResolver([]string{server.addr}, time.Second)
+
+	answer, err := r.Lookup(context.Background(), "example.com", dnsmessage.TypeMX)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(answer.Records) != 1 {
+		t.Errorf("got %d records, want 1", len(answer.Records))
+	}
+}
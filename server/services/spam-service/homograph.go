@@ -0,0 +1,134 @@
+package spamservice
+
+import (
+	"strings"
+	"unicode"
+)
+
+// scriptTables are the scripts told apart when checking for mixing. Common
+// and inherited characters (digits, hyphens, combining marks) belong to none
+var scriptTables = map[string]*unicode.RangeTable{
+	"Latin":      unicode.Latin,
+	"Cyrillic":   unicode.Cyrillic,
+	"Greek":      unicode.Greek,
+	"Armenian":   unicode.Armenian,
+	"Georgian":   unicode.Georgian,
+	"Hebrew":     unicode.Hebrew,
+	"Arabic":     unicode.Arabic,
+	"Devanagari": unicode.Devanagari,
+	"Bengali":    unicode.Bengali,
+	"Tamil":      unicode.Tamil,
+	"Thai":       unicode.Thai,
+	"Han":        unicode.Han,
+	"Hiragana":   unicode.Hiragana,
+	"Katakana":   unicode.Katakana,
+	"Bopomofo":   unicode.Bopomofo,
+	"Hangul":     unicode.Hangul,
+	"Cherokee":   unicode.Cherokee,
+}
+
+// allowedScriptMixes are the combinations UTS #39's highly restrictive level
+// permits, for writing systems that mix scripts by design
+var allowedScriptMixes = []map[string]bool{
+	{"Latin": true, "Han": true, "Hiragana": true, "Katakana": true}, // Japanese
+	{"Latin": true, "Han": true, "Bopomofo": true},                   // Chinese
+	{"Latin": true, "Han": true, "Hangul": true},                     // Korean
+}
+
+// confusables maps characters to the Latin letters they are drawn like, a
+// subset of the UTS #39 confusables data covering scripts used against Latin
+// domains. Multi-rune sequences are handled in skeleton
+var confusables = map[rune]string{
+	// Cyrillic
+	'а': "a", 'в': "b", 'с': "c", 'ԁ': "d", 'е': "e", 'ё': "e", 'һ': "h",
+	'і': "i", 'ї': "i", 'ј': "j", 'к': "k", 'ӏ': "l", 'м': "m", 'п': "n",
+	'о': "o", 'р': "p", 'ԛ': "q", 'г': "r", 'ѕ': "s", 'т': "t", 'ц': "u",
+	'ѵ': "v", 'ԝ': "w", 'х': "x", 'у': "y", 'ӡ': "3", 'ь': "b",
+	// Greek
+	'α': "a", 'β': "b", 'ε': "e", 'η': "n", 'ι': "i", 'κ': "k", 'ν': "v",
+	'ο': "o", 'ρ': "p", 'τ': "t", 'υ': "u", 'χ': "x", 'γ': "y", 'ω': "w",
+	// Armenian
+	'օ': "o", 'ս': "u", 'հ': "h", 'ց': "g", 'զ': "q",
+	// Latin lookalikes
+	'ı': "i", 'ɩ': "i", 'ɡ': "g", 'ɑ': "a", 'ʀ': "r", 'ꞵ': "b", 'ƅ': "b",
+	'ℓ': "l", 'ɴ': "n", 'ᴏ': "o", 'ѡ': "w",
+	// Digits drawn like letters
+	'0': "o", '1': "l",
+}
+
+// multiRuneConfusables are ASCII sequences read as a single letter
+var multiRuneConfusables = strings.NewReplacer("rn", "m", "vv", "w", "cl", "d")
+
+// homographSkeletons maps each popular provider's skeleton back to it
+var homographSkeletons = func() map[string]string {
+	skeletons := make(map[string]string, len(popularProviders))
+	for _, provider := range popularProviders {
+		skeletons[skeleton(provider)] = provider
+	}
+	return skeletons
+}()
+
+// isMixedScript reports whether any label of the domain combines scripts
+// outside the mixes UTS #39 allows
+func isMixedScript(domain string) bool {
+	for _, label := range strings.Split(domain, ".") {
+		scripts := map[string]bool{}
+		for _, r := range label {
+			for name, table := range scriptTables {
+				if unicode.Is(table, r) {
+					scripts[name] = true
+					break
+				}
+			}
+		}
+
+		if len(scripts) <= 1 {
+			continue
+		}
+		if !isAllowedScriptMix(scripts) {
+			return true
+		}
+	}
+	return false
+}
+
+func isAllowedScriptMix(scripts map[string]bool) bool {
+	for _, allowed := range allowedScriptMixes {
+		ok := true
+		for script := range scripts {
+			if !allowed[script] {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// skeleton reduces a string to the characters it looks like, so two strings
+// with the same skeleton are visually confusable
+func skeleton(s string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(s) {
+		if mapped, ok := confusables[r]; ok {
+			b.WriteString(mapped)
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	return multiRuneConfusables.Replace(b.String())
+}
+
+// detectHomograph returns the popular domain the given one is drawn like, or ""
+func detectHomograph(unicodeDomain string) string {
+	if _, ok := providerSet[unicodeDomain]; ok {
+		return ""
+	}
+	if target, ok := homographSkeletons[skeleton(unicodeDomain)]; ok && target != unicodeDomain {
+		return target
+	}
+	return ""
+}
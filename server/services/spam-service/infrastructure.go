@@ -0,0 +1,95 @@
+package spamservice
+
+import (
+	"context"
+	"strings"
+	"sync"
+)
+
+// disposableMailHosts are MX hosts run by throwaway inbox services that
+// receive mail for domains not on the disposable list
+var disposableMailHosts = []string{
+	"mailinator.com",
+	"guerrillamail.com",
+	"sharklasers.com",
+	"temp-mail.org",
+	"tempmail.plus",
+	"mail.tm",
+	"yopmail.com",
+	"10minutemail.com",
+	"maildrop.cc",
+	"mailnesia.com",
+	"dropmail.me",
+	"emailondeck.com",
+	"getnada.com",
+	"trashmail.com",
+	"mohmal.com",
+	"mail.gw",
+}
+
+// domainConfig is what a domain's DNS says about how seriously it handles
+// mail. Fields are only set when the lookups succeeded
+type domainConfig struct {
+	missingSPF   bool
+	missingDMARC bool
+	disposableMX string // the offending MX host
+}
+
+// isNullMX is RFC 7505's single MX of "." declaring the domain takes no mail
+func isNullMX(mxHosts []string) bool {
+	return len(mxHosts) == 1 && mxHosts[0] == ""
+}
+
+// checkDomainConfig looks up SPF and DMARC policies and inspects the MX hosts
+func checkDomainConfig(ctx context.Context, domain string, mxHosts []string) domainConfig {
+	config := domainConfig{}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		if records, err := lookupTXT(ctx, domain); err == nil {
+			config.missingSPF = !hasRecordPrefix(records, "v=spf1")
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		if records, err := lookupTXT(ctx, "_dmarc."+domain); err == nil {
+			config.missingDMARC = !hasRecordPrefix(records, "v=dmarc1")
+		}
+	}()
+
+	for _, host := range mxHosts {
+		if isDisposableMailHost(host) {
+			config.disposableMX = host
+			break
+		}
+	}
+
+	wg.Wait()
+	return config
+}
+
+func isDisposableMailHost(host string) bool {
+	if isDisposableDomain(host) {
+		return true
+	}
+	for _, infra := range disposableMailHosts {
+		if domainMatches(host, infra) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasRecordPrefix matches the version tag case-insensitively, and exactly,
+// so v=spf10 isn't mistaken for SPF
+func hasRecordPrefix(records []string, prefix string) bool {
+	for _, record := range records {
+		record = strings.ToLower(strings.TrimSpace(record))
+		if record == prefix || strings.HasPrefix(record, prefix+" ") || strings.HasPrefix(record, prefix+";") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,576 @@
+package spamservice
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"katanaid/database"
+	"katanaid/middleware"
+	"katanaid/models"
+	"katanaid/util"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5"
+)
+
+// Job statuses
+const (
+	JobPending   = "pending"
+	JobRunning   = "running"
+	JobCompleted = "completed"
+)
+
+const (
+	maxJobUploadBytes   = 32 << 20
+	maxJobRows          = 100000
+	defaultJobWorkers   = 4
+	jobBatchSize        = 50
+	jobIdlePoll         = 2 * time.Second
+	jobClaimTimeout     = 5 * time.Minute // claimed items older than this are retried
+	jobResultsCSVHeader = "email,risk_score,suggestion,flags,did_you_mean,role_account,free_provider,domain_type,format_error"
+)
+
+// jobWake nudges idle workers when a job is created
+var jobWake = make(chan struct{}, 1)
+
+// =============================================================================
+// REQ / RES TYPES
+// =============================================================================
+
+type JobResponse struct {
+	JobID       string       `json:"job_id"`
+	Status      string       `json:"status"`
+	Total       int          `json:"total"`
+	Processed   int          `json:"processed"`
+	Summary     *BulkSummary `json:"summary,omitempty"`
+	CreatedAt   string       `json:"created_at"`
+	CompletedAt *string      `json:"completed_at,omitempty"`
+}
+
+// =============================================================================
+// HANDLERS
+// =============================================================================
+
+// CreateEmailJob accepts a CSV or newline-separated list, either as the raw
+// body or as the "file" field of a multipart form, and queues every address
+func CreateEmailJob(w http.ResponseWriter, r *http.Request) {
+	key, ok := middleware.GetAPIKeyFromContext(r.Context())
+	if !ok {
+		util.WriteJSON(w, http.StatusUnauthorized, models.ErrorResponse{Error: "API key required"})
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxJobUploadBytes)
+
+	upload, err := jobUpload(r)
+	if err != nil {
+		util.WriteJSON(w, http.StatusBadRequest, models.ErrorResponse{Error: "Invalid upload"})
+		return
+	}
+	defer upload.Close()
+
+	emails, err := readEmailList(upload)
+	if err != nil {
+		util.WriteJSON(w, http.StatusBadRequest, models.ErrorResponse{Error: err.Error()})
+		return
+	}
+	if len(emails) == 0 {
+		util.WriteJSON(w, http.StatusBadRequest, models.ErrorResponse{Error: "At least one email is required"})
+		return
+	}
+
+	smtpCheck, _ := strconv.ParseBool(r.URL.Query().Get("smtp_check"))
+
+	jobID, err := createJob(r.Context(), key.UserID, emails, smtpCheck)
+	if err != nil {
+		log.Print("Error creating email job:", err)
+		util.WriteJSON(w, http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to create job"})
+		return
+	}
+
+	select {
+	case jobWake <- struct{}{}:
+	default:
+	}
+
+	util.WriteJSON(w, http.StatusAccepted, JobResponse{
+		JobID:     jobID,
+		Status:    JobPending,
+		Total:     len(emails),
+		CreatedAt: time.Now().UTC().Format(time.RFC3339),
+	})
+}
+
+// GetEmailJob reports a job's progress
+func GetEmailJob(w http.ResponseWriter, r *http.Request) {
+	key, ok := middleware.GetAPIKeyFromContext(r.Context())
+	if !ok {
+		util.WriteJSON(w, http.StatusUnauthorized, models.ErrorResponse{Error: "API key required"})
+		return
+	}
+
+	job := JobResponse{JobID: chi.URLParam(r, "jobID")}
+	var createdAt time.Time
+	var completedAt *time.Time
+	err := database.DB.QueryRow(
+		r.Context(),
+		`SELECT status, total, processed, created_at, completed_at
+		FROM email_jobs WHERE id = $1 AND user_id = $2`,
+		job.JobID, key.UserID,
+	).Scan(&job.Status, &job.Total, &job.Processed, &createdAt, &completedAt)
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		util.WriteJSON(w, http.StatusNotFound, models.ErrorResponse{Error: "Job not found"})
+		return
+	}
+	if err != nil {
+		log.Print("Error fetching email job:", err)
+		util.WriteJSON(w, http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to fetch job"})
+		return
+	}
+
+	job.CreatedAt = createdAt.UTC().Format(time.RFC3339)
+	if completedAt != nil {
+		formatted := completedAt.UTC().Format(time.RFC3339)
+		job.CompletedAt = &formatted
+	}
+
+	summary, err := jobSummary(r.Context(), job.JobID)
+	if err != nil {
+		log.Print("Error summarizing email job:", err)
+	} else {
+		job.Summary = &summary
+	}
+
+	util.WriteJSON(w, http.StatusOK, job)
+}
+
+// GetEmailJobResults streams the results checked so far in upload order, as
+// CSV (default) or JSON lines with ?format=jsonl
+func GetEmailJobResults(w http.ResponseWriter, r *http.Request) {
+	key, ok := middleware.GetAPIKeyFromContext(r.Context())
+	if !ok {
+		util.WriteJSON(w, http.StatusUnauthorized, models.ErrorResponse{Error: "API key required"})
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	if format != "csv" && format != "jsonl" {
+		util.WriteJSON(w, http.StatusBadRequest, models.ErrorResponse{Error: "Format must be csv or jsonl"})
+		return
+	}
+
+	jobID := chi.URLParam(r, "jobID")
+	var exists bool
+	err := database.DB.QueryRow(
+		r.Context(),
+		`SELECT EXISTS(SELECT 1 FROM email_jobs WHERE id = $1 AND user_id = $2)`,
+		jobID, key.UserID,
+	).Scan(&exists)
+	if err != nil {
+		log.Print("Error fetching email job:", err)
+		util.WriteJSON(w, http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to fetch job"})
+		return
+	}
+	if !exists {
+		util.WriteJSON(w, http.StatusNotFound, models.ErrorResponse{Error: "Job not found"})
+		return
+	}
+
+	rows, err := database.DB.Query(
+		r.Context(),
+		`SELECT result FROM email_job_items
+		WHERE job_id = $1 AND status = 'done' ORDER BY position`,
+		jobID,
+	)
+	if err != nil {
+		log.Print("Error fetching email job results:", err)
+		util.WriteJSON(w, http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to fetch results"})
+		return
+	}
+	defer rows.Close()
+
+	if format == "jsonl" {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	} else {
+		w.Header().Set("Content-Type", "text/csv")
+	}
+	w.Header().Set("Content-Disposition", `attachment; filename="`+jobID+`.`+format+`"`)
+	w.WriteHeader(http.StatusOK)
+
+	out := bufio.NewWriter(w)
+	defer out.Flush()
+
+	csvWriter := csv.NewWriter(out)
+	if format == "csv" {
+		out.WriteString(jobResultsCSVHeader + "\n")
+	}
+
+	for rows.Next() {
+		var raw []byte
+		if err := rows.Scan(&raw); err != nil {
+			log.Print("Error scanning email job result:", err)
+			return
+		}
+
+		if format == "jsonl" {
+			out.Write(raw)
+			out.WriteByte('\n')
+			continue
+		}
+
+		var result EmailCheckResult
+		if err := json.Unmarshal(raw, &result); err != nil {
+			continue
+		}
+		csvWriter.Write(resultCSVRecord(result))
+		csvWriter.Flush()
+	}
+}
+
+// =============================================================================
+// WORKERS
+// =============================================================================
+
+// StartJobWorkers runs EMAIL_JOB_WORKERS (default 4) background workers.
+// Progress lives in Postgres, so jobs interrupted by a restart carry on where
+// they stopped
+func StartJobWorkers() {
+	workers := defaultJobWorkers
+	if value, err := strconv.Atoi(os.Getenv("EMAIL_JOB_WORKERS")); err == nil && value > 0 {
+		workers = value
+	}
+
+	for range workers {
+		go jobWorker()
+	}
+}
+
+func jobWorker() {
+	for {
+		processed, err := processJobBatch(context.Background())
+		if err != nil {
+			log.Print("Error processing email job batch:", err)
+		}
+		if processed > 0 && err == nil {
+			continue
+		}
+
+		select {
+		case <-jobWake:
+		case <-time.After(jobIdlePoll):
+		}
+	}
+}
+
+type jobItem struct {
+	id        int64
+	jobID     string
+	email     string
+	userID    int
+	smtpCheck bool
+}
+
+// processJobBatch claims up to jobBatchSize pending items from the oldest
+// job, checks them and records the results
+func processJobBatch(ctx context.Context) (int, error) {
+	items, err := claimJobItems(ctx)
+	if err != nil || len(items) == 0 {
+		return 0, err
+	}
+
+	jobID := items[0].jobID
+	_, err = database.DB.Exec(
+		ctx,
+		`UPDATE email_jobs SET status = $2, started_at = COALESCE(started_at, NOW())
+		WHERE id = $1 AND status = $3`,
+		jobID, JobRunning, JobPending,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	rules, err := loadCustomerRules(ctx, items[0].userID)
+	if err != nil {
+		return 0, err
+	}
+
+	emails := make([]string, len(items))
+	for i, item := range items {
+		emails[i] = item.email
+	}
+	results := analyzeEmails(ctx, emails, checkOptions{rules: rules, smtpCheck: items[0].smtpCheck})
+
+	batch := &pgx.Batch{}
+	for i, item := range items {
+		raw, err := json.Marshal(results[i])
+		if err != nil {
+			return 0, err
+		}
+		batch.Queue(
+			`UPDATE email_job_items SET status = 'done', suggestion = $2, result = $3 WHERE id = $1`,
+			item.id, results[i].Suggestion, raw,
+		)
+	}
+	if err := database.DB.SendBatch(ctx, batch).Close(); err != nil {
+		return 0, err
+	}
+
+	for i, item := range items {
+		logSpamCheck(item.email, results[i])
+	}
+
+	// Counting rather than incrementing keeps progress right if a batch is
+	// ever processed twice
+	_, err = database.DB.Exec(
+		ctx,
+		`UPDATE email_jobs SET
+			processed = counted.done,
+			status = CASE WHEN counted.done >= total THEN $2 ELSE status END,
+			completed_at = CASE WHEN counted.done >= total THEN NOW() ELSE completed_at END
+		FROM (SELECT COUNT(*) AS done FROM email_job_items WHERE job_id = $1 AND status = 'done') counted
+		WHERE id = $1`,
+		jobID, JobCompleted,
+	)
+	return len(items), err
+}
+
+// claimJobItems takes a batch from one job. SKIP LOCKED lets workers on any
+// number of replicas share the queue, and items whose claim went stale (the
+// worker died) become claimable again
+func claimJobItems(ctx context.Context) ([]jobItem, error) {
+	rows, err := database.DB.Query(
+		ctx,
+		`WITH next_job AS (
+			SELECT job_id FROM email_job_items
+			WHERE status = 'pending' OR (status = 'claimed' AND claimed_at < $1)
+			ORDER BY id LIMIT 1
+		), claimed AS (
+			UPDATE email_job_items SET status = 'claimed', claimed_at = NOW()
+			WHERE id IN (
+				SELECT id FROM email_job_items
+				WHERE job_id = (SELECT job_id FROM next_job)
+				AND (status = 'pending' OR (status = 'claimed' AND claimed_at < $1))
+				ORDER BY position
+				LIMIT $2
+				FOR UPDATE SKIP LOCKED
+			)
+			RETURNING id, job_id, email
+		)
+		SELECT claimed.id, claimed.job_id, claimed.email, j.user_id, j.smtp_check
+		FROM claimed JOIN email_jobs j ON j.id = claimed.job_id`,
+		time.Now().Add(-jobClaimTimeout), jobBatchSize,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []jobItem{}
+	for rows.Next() {
+		var item jobItem
+		if err := rows.Scan(&item.id, &item.jobID, &item.email, &item.userID, &item.smtpCheck); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+// =============================================================================
+// HELPERS
+// =============================================================================
+
+func createJob(ctx context.Context, userID int, emails []string, smtpCheck bool) (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	jobID := hex.EncodeToString(id)
+
+	tx, err := database.DB.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(
+		ctx,
+		`INSERT INTO email_jobs (id, user_id, smtp_check, total) VALUES ($1, $2, $3, $4)`,
+		jobID, userID, smtpCheck, len(emails),
+	)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = tx.CopyFrom(
+		ctx,
+		pgx.Identifier{"email_job_items"},
+		[]string{"job_id", "position", "email"},
+		pgx.CopyFromSlice(len(emails), func(i int) ([]any, error) {
+			return []any{jobID, i, emails[i]}, nil
+		}),
+	)
+	if err != nil {
+		return "", err
+	}
+
+	return jobID, tx.Commit(ctx)
+}
+
+func jobSummary(ctx context.Context, jobID string) (BulkSummary, error) {
+	rows, err := database.DB.Query(
+		ctx,
+		`SELECT suggestion, COUNT(*) FROM email_job_items
+		WHERE job_id = $1 AND status = 'done' GROUP BY suggestion`,
+		jobID,
+	)
+	if err != nil {
+		return BulkSummary{}, err
+	}
+	defer rows.Close()
+
+	summary := BulkSummary{}
+	for rows.Next() {
+		var suggestion string
+		var count int
+		if err := rows.Scan(&suggestion, &count); err != nil {
+			return BulkSummary{}, err
+		}
+		summary.Total += count
+		switch suggestion {
+		case "allow":
+			summary.Safe = count
+		case "review":
+			summary.Suspicious = count
+		case "block":
+			summary.Risky = count
+		}
+	}
+	return summary, rows.Err()
+}
+
+// jobUpload returns the uploaded list from a multipart "file" field or the
+// raw request body
+func jobUpload(r *http.Request) (io.ReadCloser, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "multipart/form-data" {
+		return r.Body, nil
+	}
+
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// readEmailList reads a whole upload, up to maxJobRows addresses
+func readEmailList(upload io.Reader) ([]string, error) {
+	emails := []string{}
+	err := scanEmailList(upload, func(email string) error {
+		if len(emails) >= maxJobRows {
+			return errors.New("Maximum " + strconv.Itoa(maxJobRows) + " emails allowed")
+		}
+		emails = append(emails, email)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return emails, nil
+}
+
+// scanEmailList reads a CSV or a plain list, passing each address to emit as
+// it goes. The column named email (or e-mail, email_address) is used when the
+// first row is a header, otherwise the first column holding an address
+func scanEmailList(upload io.Reader, emit func(email string) error) error {
+	reader := csv.NewReader(upload)
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	reader.TrimLeadingSpace = true
+
+	column := -1 // picked from the first row holding an address
+	first := true
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.New("Could not parse upload")
+		}
+
+		if first {
+			first = false
+			if header := emailColumn(record); header >= 0 {
+				column = header
+				continue
+			}
+		}
+
+		if column < 0 {
+			if column = slices.IndexFunc(record, isAddressLike); column < 0 {
+				continue // a header, or a row with nothing to check
+			}
+		}
+		if column >= len(record) {
+			continue
+		}
+		email := strings.ToLower(strings.TrimSpace(record[column]))
+		if email == "" {
+			continue
+		}
+
+		if err := emit(email); err != nil {
+			return err
+		}
+	}
+}
+
+// resultCSVRecord is one result as a row under jobResultsCSVHeader
+func resultCSVRecord(result EmailCheckResult) []string {
+	return []string{
+		result.Email,
+		strconv.FormatFloat(result.RiskScore, 'f', 2, 64),
+		result.Suggestion,
+		strings.Join(result.Flags, "|"),
+		result.DidYouMean,
+		strconv.FormatBool(result.RoleAccount),
+		strconv.FormatBool(result.FreeProvider),
+		result.DomainType,
+		result.FormatError,
+	}
+}
+
+func isAddressLike(cell string) bool {
+	return strings.Contains(cell, "@")
+}
+
+func emailColumn(header []string) int {
+	for i, name := range header {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "email", "e-mail", "email_address", "email address":
+			return i
+		}
+	}
+	return -1
+}
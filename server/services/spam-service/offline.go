@@ -0,0 +1,92 @@
+package spamservice
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+// offlineBatchSize bounds how many addresses are held in memory at once
+const offlineBatchSize = 1000
+
+// OfflineOptions selects the checks and output of CheckEmailStream
+type OfflineOptions struct {
+	DNS    bool   // MX, SPF and DMARC lookups
+	SMTP   bool   // mailbox probes, which need DNS
+	Format string // "jsonl" (default) or "csv"
+}
+
+// CheckEmailStream runs the email checks over a CSV or plain list, read the
+// same way as job uploads, and writes one result per address in input order.
+// It needs no database, so customer rules and the history and reputation
+// checks are skipped
+func CheckEmailStream(ctx context.Context, in io.Reader, out io.Writer, opts OfflineOptions) (BulkSummary, error) {
+	if opts.Format == "" {
+		opts.Format = "jsonl"
+	}
+	if opts.Format != "jsonl" && opts.Format != "csv" {
+		return BulkSummary{}, errors.New("format must be jsonl or csv")
+	}
+	if opts.SMTP && !opts.DNS {
+		return BulkSummary{}, errors.New("SMTP checks need DNS checks enabled")
+	}
+
+	checks := checkOptions{smtpCheck: opts.SMTP, skipDNS: !opts.DNS, offline: true}
+	summary := BulkSummary{}
+
+	buffered := bufio.NewWriter(out)
+	csvWriter := csv.NewWriter(buffered)
+	encoder := json.NewEncoder(buffered)
+	if opts.Format == "csv" {
+		buffered.WriteString(jobResultsCSVHeader + "\n")
+	}
+
+	flush := func(emails []string) error {
+		for _, result := range analyzeEmails(ctx, emails, checks) {
+			summary.Total++
+			switch result.Suggestion {
+			case "allow":
+				summary.Safe++
+			case "review":
+				summary.Suspicious++
+			case "block":
+				summary.Risky++
+			}
+
+			if opts.Format == "csv" {
+				csvWriter.Write(resultCSVRecord(result))
+				continue
+			}
+			if err := encoder.Encode(result); err != nil {
+				return err
+			}
+		}
+		csvWriter.Flush()
+		if err := csvWriter.Error(); err != nil {
+			return err
+		}
+		return buffered.Flush()
+	}
+
+	batch := make([]string, 0, offlineBatchSize)
+	err := scanEmailList(in, func(email string) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		batch = append(batch, email)
+		if len(batch) < offlineBatchSize {
+			return nil
+		}
+		err := flush(batch)
+		batch = batch[:0]
+		return err
+	})
+	if err != nil {
+		return summary, err
+	}
+
+	return summary, flush(batch)
+}
@@ -0,0 +1,58 @@
+package spamservice
+
+// popularProviders are the mailbox providers typosquats are checked against,
+// most popular first so ties resolve to the likelier intent. Regional variants
+// are listed so they are never mistaken for typos of each other
+var popularProviders = []string{
+	"gmail.com",
+	"yahoo.com",
+	"hotmail.com",
+	"outlook.com",
+	"icloud.com",
+	"aol.com",
+	"live.com",
+	"msn.com",
+	"protonmail.com",
+	"proton.me",
+	"gmx.com",
+	"gmx.de",
+	"gmx.net",
+	"mail.com",
+	"email.com",
+	"zoho.com",
+	"yandex.com",
+	"yandex.ru",
+	"mail.ru",
+	"me.com",
+	"mac.com",
+	"googlemail.com",
+	"ymail.com",
+	"rocketmail.com",
+	"fastmail.com",
+	"hey.com",
+	"tutanota.com",
+	"web.de",
+	"qq.com",
+	"163.com",
+	"naver.com",
+	"comcast.net",
+	"verizon.net",
+	"att.net",
+	"sbcglobal.net",
+	"yahoo.co.uk",
+	"yahoo.co.in",
+	"yahoo.fr",
+	"yahoo.de",
+	"hotmail.co.uk",
+	"hotmail.fr",
+	"hotmail.de",
+	"hotmail.it",
+	"outlook.fr",
+	"outlook.de",
+	"live.co.uk",
+	"btinternet.com",
+	"orange.fr",
+	"free.fr",
+	"laposte.net",
+	"libero.it",
+}
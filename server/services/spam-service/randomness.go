@@ -0,0 +1,271 @@
+package spamservice
+
+import (
+	"bufio"
+	_ "embed"
+	"math"
+	"strings"
+)
+
+//go:embed data/localpart_corpus.txt
+var localPartCorpus string
+
+const (
+	defaultRandomnessThreshold = 0.6
+	minRandomnessLength        = 6   // shorter local parts carry too little evidence
+	bigramSmoothing            = 0.5 // add-k smoothing for unseen letter pairs
+	maxNaturalDigitRun         = 4   // years and house numbers
+	trailingDigitWeight        = 0.5 // a number after a name is mostly a suffix
+	minCompoundPart            = 4   // shortest word tried when splitting compounds
+	repeatingScore             = 0.8 // floor for a string that repeats one unit
+	boundary                   = 26  // start or end of a word in the bigram table
+)
+
+// bigramModel scores letter sequences by how unlike the corpus they read.
+// natural and uniform are the mean cost, in bits per transition, of corpus
+// words and of uniformly random letters, and anchor the 0-1 scale
+type bigramModel struct {
+	cost    [27][27]float64 // -log2 P(next | prev)
+	natural float64
+	uniform float64
+}
+
+var localPartModel = trainBigramModel(localPartCorpus)
+
+// commonHandleWords are generic words that make up many real handles, scored
+// as natural whatever the bigram model makes of them
+var commonHandleWords = map[string]bool{
+	"user": true, "admin": true, "test": true, "info": true, "mail": true, "email": true,
+	"contact": true, "support": true, "hello": true, "office": true, "team": true,
+	"sales": true, "the": true, "real": true, "official": true, "guest": true,
+	"player": true, "gamer": true, "dev": true, "web": true, "noreply": true,
+}
+
+func trainBigramModel(corpus string) *bigramModel {
+	var counts [27][27]float64
+	words := []string{}
+
+	scanner := bufio.NewScanner(strings.NewReader(corpus))
+	for scanner.Scan() {
+		word := strings.ToLower(strings.TrimSpace(scanner.Text()))
+		if word == "" || strings.HasPrefix(word, "#") {
+			continue
+		}
+		words = append(words, word)
+
+		prev := boundary
+		for i := 0; i < len(word); i++ {
+			if c := word[i]; c >= 'a' && c <= 'z' {
+				counts[prev][c-'a']++
+				prev = int(c - 'a')
+			}
+		}
+		counts[prev][boundary]++
+	}
+
+	model := &bigramModel{}
+	for prev := range counts {
+		total := 0.0
+		for _, count := range counts[prev] {
+			total += count
+		}
+		for next, count := range counts[prev] {
+			model.cost[prev][next] = -math.Log2((count + bigramSmoothing) / (total + 27*bigramSmoothing))
+		}
+	}
+
+	for _, word := range words {
+		model.natural += model.wordCost(word)
+	}
+	model.natural /= float64(len(words))
+
+	// Expected cost of a letter drawn uniformly after any letter
+	for prev := 0; prev < 26; prev++ {
+		for next := 0; next < 26; next++ {
+			model.uniform += model.cost[prev][next]
+		}
+	}
+	model.uniform /= 26 * 26
+
+	return model
+}
+
+// wordCost is the mean cost per transition of a run of letters, word
+// boundaries included
+func (m *bigramModel) wordCost(letters string) float64 {
+	total := 0.0
+	prev := boundary
+	for i := 0; i < len(letters); i++ {
+		next := int(letters[i] - 'a')
+		total += m.cost[prev][next]
+		prev = next
+	}
+	total += m.cost[prev][boundary]
+	return total / float64(len(letters)+1)
+}
+
+// score places a run of letters between the corpus (0) and random letters (1).
+// A leading initial, as in jsmith, is forgiven, and so is one missing
+// separator, as in darkknight
+func (m *bigramModel) score(letters string) float64 {
+	cost := m.wordCost(letters)
+	if len(letters) > 4 {
+		cost = min(cost, m.wordCost(letters[1:]))
+	}
+	for split := minCompoundPart; split <= len(letters)-minCompoundPart; split++ {
+		head, tail := letters[:split], letters[split:]
+		joined := (m.wordCost(head)*float64(len(head)+1) + m.wordCost(tail)*float64(len(tail)+1)) / float64(len(letters)+2)
+		cost = min(cost, joined)
+	}
+	return clamp01((cost - m.natural) / (m.uniform - m.natural))
+}
+
+// randomnessScore rates from 0 to 1 how machine-generated a local part looks.
+// Letter runs are scored by the bigram model, long digit runs count against
+// it, as does switching back and forth between letters and digits, and long
+// strings whose characters barely repeat (high Shannon entropy) are pushed up.
+// A number ending the local part, as in user1990, counts for less, and not at
+// all when it's a sequence like 12345678
+func randomnessScore(localPart string) float64 {
+	localPart = strings.ToLower(localPart)
+	if plus := strings.IndexByte(localPart, '+'); plus >= 0 {
+		localPart = localPart[:plus]
+	}
+
+	runs := characterRuns(localPart)
+	length := 0
+	for _, run := range runs {
+		length += len(run)
+	}
+	if length < minRandomnessLength {
+		return 0
+	}
+
+	// The runs before a trailing number, which is judged as a suffix
+	body := runs
+	if len(runs) > 1 && isDigitRun(runs[len(runs)-1]) {
+		body = runs[:len(runs)-1]
+	}
+
+	weighted := 0.0
+	switches := 0
+	for i, run := range runs {
+		switch {
+		case isDigitRun(run) && isDigitSequence(run):
+		case isDigitRun(run):
+			runScore := clamp01(float64(len(run)-maxNaturalDigitRun) / maxNaturalDigitRun)
+			if i == len(body) {
+				runScore *= trailingDigitWeight
+			}
+			weighted += float64(len(run)) * runScore
+		case commonHandleWords[run]:
+		default:
+			weighted += float64(len(run)) * localPartModel.score(run)
+		}
+		if i > 0 && isDigitRun(run) != isDigitRun(runs[i-1]) {
+			switches++
+		}
+	}
+	score := weighted / float64(length)
+
+	// One switch is a name followed by a number; more is a jumble like x3q9v
+	if switches > 1 {
+		score += 0.15 * float64(switches-1)
+	}
+
+	// Keyboard runs typed twice, like aeiouaeiou or asdasd
+	letters := strings.Join(body, "")
+	if isRepeating(letters) {
+		score = max(score, repeatingScore)
+	}
+
+	// Names like przemyslaw often have ten distinct letters, so only longer
+	// strings are judged on entropy
+	if len(letters) >= 12 {
+		score += 0.5 * max(0, normalizedEntropy(letters)-0.85)
+	}
+
+	return math.Round(clamp01(score)*100) / 100
+}
+
+// isRepeating reports whether s is a shorter unit repeated, the last copy
+// possibly cut short
+func isRepeating(s string) bool {
+	for unit := 1; unit <= len(s)/2; unit++ {
+		if s[unit:] == s[:len(s)-unit] {
+			return true
+		}
+	}
+	return false
+}
+
+// isDigitSequence reports whether digits count up or down by one, or repeat
+// one digit, as people type them
+func isDigitSequence(digits string) bool {
+	if len(digits) < 3 {
+		return false
+	}
+	step := (int(digits[1]) - int(digits[0]) + 10) % 10
+	if step != 0 && step != 1 && step != 9 {
+		return false
+	}
+	for i := 2; i < len(digits); i++ {
+		if (int(digits[i])-int(digits[i-1])+10)%10 != step {
+			return false
+		}
+	}
+	return true
+}
+
+// characterRuns splits a local part into runs of ASCII letters and of digits,
+// dropping separators and anything else
+func characterRuns(localPart string) []string {
+	runs := []string{}
+	start := -1
+	for i := 0; i <= len(localPart); i++ {
+		if start >= 0 && (i == len(localPart) || charClass(localPart[i]) != charClass(localPart[start])) {
+			runs = append(runs, localPart[start:i])
+			start = -1
+		}
+		if i < len(localPart) && start < 0 && charClass(localPart[i]) != 0 {
+			start = i
+		}
+	}
+	return runs
+}
+
+// charClass is 1 for letters, 2 for digits and 0 for everything else
+func charClass(c byte) int {
+	switch {
+	case c >= 'a' && c <= 'z':
+		return 1
+	case c >= '0' && c <= '9':
+		return 2
+	}
+	return 0
+}
+
+func isDigitRun(run string) bool {
+	return charClass(run[0]) == 2
+}
+
+// normalizedEntropy is the Shannon entropy of the characters over its maximum
+// for the length, so 1 means no character repeats
+func normalizedEntropy(s string) float64 {
+	counts := map[rune]int{}
+	for _, r := range s {
+		counts[r]++
+	}
+
+	entropy := 0.0
+	n := float64(len(s))
+	for _, count := range counts {
+		p := float64(count) / n
+		entropy -= p * math.Log2(p)
+	}
+	return entropy / math.Log2(min(n, 36))
+}
+
+func clamp01(x float64) float64 {
+	return min(max(x, 0), 1)
+}
@@ -0,0 +1,76 @@
+package spamservice
+
+import "testing"
+
+func TestRandomnessScore(t *testing.T) {
+	tests := []struct {
+		localPart string
+		random    bool
+	}{
+		// Real-looking handles
+		{"john.smith", false},
+		{"jsmith1990", false},
+		{"user12345678", false},
+		{"test123456", false},
+		{"admin2024", false},
+		{"maria.garcia", false},
+		{"jane.doe.1985", false},
+		{"john_doe_84", false},
+		{"darkknight", false},
+		{"support2024team", false},
+		{"mike.johnson+news", false},
+		{"przemyslaw", false},
+		{"przemyslaw.nowak", false},
+		{"jedrzejczyk", false},
+		{"krzysztofik", false},
+		{"svyatoslav", false},
+		{"siobhan", false},
+		{"nguyen", false},
+		{"xiaoming", false},
+		{"oluwaseun", false},
+		{"chukwuemeka", false},
+		{"yitzchak", false},
+
+		// Generated strings
+		{"xk3q9vz", true},
+		{"aeiouaeiou", true},
+		{"xk7qp2mzv9", true},
+		{"a8f3k2j9d1", true},
+		{"zqxjkvbwpf", true},
+		{"hjkqwzxtpr", true},
+		{"kd82jfh38dk", true},
+		{"4f8a2c9e1b7d", true},
+		{"tmp_8f2a9c1e7b", true},
+		{"83920174", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.localPart, func(t *testing.T) {
+			score := randomnessScore(tt.localPart)
+			if got := score >= defaultRandomnessThreshold; got != tt.random {
+				t.Errorf("randomnessScore(%q) = %.2f, want random: %v", tt.localPart, score, tt.random)
+			}
+		})
+	}
+}
+
+func TestIsDigitSequence(t *testing.T) {
+	tests := []struct {
+		digits string
+		want   bool
+	}{
+		{"12345678", true},
+		{"987654", true},
+		{"7890123", true},
+		{"0000", true},
+		{"12", false},
+		{"1990", false},
+		{"83920174", false},
+	}
+
+	for _, tt := range tests {
+		if got := isDigitSequence(tt.digits); got != tt.want {
+			t.Errorf("isDigitSequence(%q) = %v, want %v", tt.digits, got, tt.want)
+		}
+	}
+}
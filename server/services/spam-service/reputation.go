@@ -0,0 +1,161 @@
+package spamservice
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"katanaid/database"
+	"katanaid/models"
+	"katanaid/util"
+
+	"github.com/go-chi/chi/v5"
+	"golang.org/x/net/idna"
+)
+
+const (
+	reputationCacheTTL     = 5 * time.Minute
+	maxReputationCache     = 20000
+	newDomainWindow        = 7 * 24 * time.Hour
+	velocityBaselineWindow = 7 * 24 // hours before the current one
+	velocityMinChecks      = 20     // per hour before a spike counts
+	velocitySpikeFactor    = 5.0    // times the hourly baseline
+)
+
+// =============================================================================
+// REQ / RES TYPES
+// =============================================================================
+
+// DomainReputation summarizes what past checks say about a domain
+type DomainReputation struct {
+	Domain            string  `json:"domain"`
+	FirstSeen         *string `json:"first_seen,omitempty"`
+	TotalChecks       int     `json:"total_checks"`
+	DistinctAddresses int     `json:"distinct_addresses"`
+	ChecksLastHour    int     `json:"checks_last_hour"`
+	ChecksLastDay     int     `json:"checks_last_day"`
+	HourlyBaseline    float64 `json:"hourly_baseline"` // mean checks per hour over the prior week
+	BlockShare        float64 `json:"block_share"`     // share of checks suggested "block"
+	NewDomain         bool    `json:"new_domain"`
+	HighVelocity      bool    `json:"high_velocity"`
+}
+
+type reputationEntry struct {
+	reputation DomainReputation
+	expiresAt  time.Time
+}
+
+var (
+	reputationMu    sync.Mutex
+	reputationCache = make(map[string]reputationEntry)
+)
+
+// =============================================================================
+// HANDLERS
+// =============================================================================
+
+// GetDomainReputation returns the reputation built from spam_checks history
+func GetDomainReputation(w http.ResponseWriter, r *http.Request) {
+	domain, err := idna.Lookup.ToASCII(strings.TrimSpace(chi.URLParam(r, "domain")))
+	if err != nil || validateDomain(domain) != nil {
+		util.WriteJSON(w, http.StatusBadRequest, models.ErrorResponse{Error: "Invalid domain"})
+		return
+	}
+
+	reputation, err := loadDomainReputation(r.Context(), domain)
+	if err != nil {
+		log.Print("Error loading domain reputation:", err)
+		util.WriteJSON(w, http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to load reputation"})
+		return
+	}
+
+	util.WriteJSON(w, http.StatusOK, reputation)
+}
+
+// =============================================================================
+// REPUTATION
+// =============================================================================
+
+// domainReputation serves from a short-lived cache; the aggregate scans a
+// domain's whole history
+func domainReputation(ctx context.Context, domain string) (DomainReputation, error) {
+	reputationMu.Lock()
+	entry, ok := reputationCache[domain]
+	reputationMu.Unlock()
+	if ok && time.Now().Before(entry.expiresAt) {
+		return entry.reputation, nil
+	}
+
+	reputation, err := loadDomainReputation(ctx, domain)
+	if err != nil {
+		return DomainReputation{}, err
+	}
+
+	reputationMu.Lock()
+	if len(reputationCache) >= maxReputationCache {
+		now := time.Now()
+		for key, entry := range reputationCache {
+			if now.After(entry.expiresAt) {
+				delete(reputationCache, key)
+			}
+		}
+	}
+	if len(reputationCache) < maxReputationCache {
+		reputationCache[domain] = reputationEntry{reputation: reputation, expiresAt: time.Now().Add(reputationCacheTTL)}
+	}
+	reputationMu.Unlock()
+
+	return reputation, nil
+}
+
+func loadDomainReputation(ctx context.Context, domain string) (DomainReputation, error) {
+	reputation := DomainReputation{Domain: domain}
+	var firstSeen *time.Time
+	var baselineChecks, blocked int
+
+	err := database.DB.QueryRow(
+		ctx,
+		`SELECT
+			MIN(checked_at),
+			COUNT(*),
+			COUNT(DISTINCT email_hash),
+			COUNT(*) FILTER (WHERE checked_at > NOW() - INTERVAL '1 hour'),
+			COUNT(*) FILTER (WHERE checked_at > NOW() - INTERVAL '1 day'),
+			COUNT(*) FILTER (WHERE checked_at <= NOW() - INTERVAL '1 hour'
+				AND checked_at > NOW() - INTERVAL '1 hour' * ($2 + 1)),
+			COUNT(*) FILTER (WHERE suggestion = 'block'),
+			COALESCE(MIN(checked_at) > NOW() - INTERVAL '1 hour' * $3, TRUE)
+		FROM spam_checks WHERE domain = $1`,
+		domain, velocityBaselineWindow, newDomainWindow.Hours(),
+	).Scan(
+		&firstSeen,
+		&reputation.TotalChecks,
+		&reputation.DistinctAddresses,
+		&reputation.ChecksLastHour,
+		&reputation.ChecksLastDay,
+		&baselineChecks,
+		&blocked,
+		&reputation.NewDomain, // a domain we've never checked is as new as it gets
+	)
+	if err != nil {
+		return DomainReputation{}, err
+	}
+
+	if firstSeen != nil {
+		formatted := firstSeen.UTC().Format(time.RFC3339)
+		reputation.FirstSeen = &formatted
+	}
+
+	reputation.HourlyBaseline = float64(baselineChecks) / velocityBaselineWindow
+	reputation.HighVelocity = reputation.ChecksLastHour >= velocityMinChecks &&
+		float64(reputation.ChecksLastHour) >= velocitySpikeFactor*max(reputation.HourlyBaseline, 1)
+
+	if reputation.TotalChecks > 0 {
+		reputation.BlockShare = float64(blocked) / float64(reputation.TotalChecks)
+	}
+
+	return reputation, nil
+}
@@ -0,0 +1,279 @@
+package spamservice
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"katanaid/database"
+	"katanaid/middleware"
+	"katanaid/models"
+	"katanaid/util"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Rule kinds a customer can configure
+const (
+	RuleAllowDomain       = "allow_domain"
+	RuleBlockDomain       = "block_domain"
+	RuleBlockLocalPattern = "block_local_pattern" // regexp matched against the local part
+)
+
+const maxRulesPerUser = 500
+
+// =============================================================================
+// REQ / RES TYPES
+// =============================================================================
+
+type EmailRule struct {
+	ID      int    `json:"id"`
+	Kind    string `json:"kind"`
+	Pattern string `json:"pattern"`
+}
+
+type CreateEmailRuleRequest struct {
+	Kind    string `json:"kind"`
+	Pattern string `json:"pattern"`
+}
+
+// customerRules is one account's rules, compiled for a single request
+type customerRules struct {
+	allowDomains  []string
+	blockDomains  []string
+	localPatterns []*regexp.Regexp
+}
+
+// =============================================================================
+// HANDLERS
+// =============================================================================
+
+func ListEmailRules(w http.ResponseWriter, r *http.Request) {
+	user, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		util.WriteJSON(w, http.StatusUnauthorized, models.ErrorResponse{Error: "Unauthorized"})
+		return
+	}
+
+	rules, err := fetchEmailRules(r.Context(), user.UserID)
+	if err != nil {
+		log.Print("Error listing email rules:", err)
+		util.WriteJSON(w, http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to list rules"})
+		return
+	}
+
+	util.WriteJSON(w, http.StatusOK, rules)
+}
+
+func CreateEmailRule(w http.ResponseWriter, r *http.Request) {
+	user, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		util.WriteJSON(w, http.StatusUnauthorized, models.ErrorResponse{Error: "Unauthorized"})
+		return
+	}
+
+	var req CreateEmailRuleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		util.WriteJSON(w, http.StatusBadRequest, models.ErrorResponse{Error: "Invalid request"})
+		return
+	}
+
+	rule, err := normalizeRule(req)
+	if err != nil {
+		util.WriteJSON(w, http.StatusBadRequest, models.ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	var count int
+	err = database.DB.QueryRow(
+		r.Context(),
+		`SELECT COUNT(*) FROM email_rules WHERE user_id = $1`,
+		user.UserID,
+	).Scan(&count)
+	if err != nil {
+		log.Print("Error counting email rules:", err)
+		util.WriteJSON(w, http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to create rule"})
+		return
+	}
+	if count >= maxRulesPerUser {
+		util.WriteJSON(w, http.StatusBadRequest, models.ErrorResponse{Error: "Rule limit reached"})
+		return
+	}
+
+	err = database.DB.QueryRow(
+		r.Context(),
+		`INSERT INTO email_rules (user_id, kind, pattern) VALUES ($1, $2, $3) RETURNING id`,
+		user.UserID, rule.Kind, rule.Pattern,
+	).Scan(&rule.ID)
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+		util.WriteJSON(w, http.StatusConflict, models.ErrorResponse{Error: "Rule already exists"})
+		return
+	}
+	if err != nil {
+		log.Print("Error creating email rule:", err)
+		util.WriteJSON(w, http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to create rule"})
+		return
+	}
+
+	util.WriteJSON(w, http.StatusCreated, rule)
+}
+
+func DeleteEmailRule(w http.ResponseWriter, r *http.Request) {
+	user, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		util.WriteJSON(w, http.StatusUnauthorized, models.ErrorResponse{Error: "Unauthorized"})
+		return
+	}
+
+	ruleID, err := strconv.Atoi(chi.URLParam(r, "ruleID"))
+	if err != nil {
+		util.WriteJSON(w, http.StatusBadRequest, models.ErrorResponse{Error: "Invalid rule ID"})
+		return
+	}
+
+	tag, err := database.DB.Exec(
+		r.Context(),
+		`DELETE FROM email_rules WHERE id = $1 AND user_id = $2`,
+		ruleID, user.UserID,
+	)
+	if err != nil {
+		log.Print("Error deleting email rule:", err)
+		util.WriteJSON(w, http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to delete rule"})
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		util.WriteJSON(w, http.StatusNotFound, models.ErrorResponse{Error: "Rule not found"})
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// =============================================================================
+// MATCHING
+// =============================================================================
+
+// rulesForRequest loads the rules of the account behind the request's API key.
+// Anonymous requests get nil, which matches nothing
+func rulesForRequest(r *http.Request) (*customerRules, error) {
+	key, ok := middleware.GetAPIKeyFromContext(r.Context())
+	if !ok {
+		return nil, nil
+	}
+	return loadCustomerRules(r.Context(), key.UserID)
+}
+
+func loadCustomerRules(ctx context.Context, userID int) (*customerRules, error) {
+	stored, err := fetchEmailRules(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	rules := &customerRules{}
+	for _, rule := range stored {
+		switch rule.Kind {
+		case RuleAllowDomain:
+			rules.allowDomains = append(rules.allowDomains, rule.Pattern)
+		case RuleBlockDomain:
+			rules.blockDomains = append(rules.blockDomains, rule.Pattern)
+		case RuleBlockLocalPattern:
+			// Patterns are validated on create; skip any that no longer compile
+			if re, err := regexp.Compile(rule.Pattern); err == nil {
+				rules.localPatterns = append(rules.localPatterns, re)
+			}
+		}
+	}
+	return rules, nil
+}
+
+// match returns the flag of the first matching rule and whether it allows or
+// blocks. Local-part patterns are checked first so they can still catch
+// addresses on an allowlisted domain; allowlisted domains win over blocked ones
+func (rules *customerRules) match(localPart, domain string) (flag string, allow bool, matched bool) {
+	if rules == nil {
+		return "", false, false
+	}
+
+	for _, re := range rules.localPatterns {
+		if re.MatchString(localPart) {
+			return "rule:" + RuleBlockLocalPattern + ":" + re.String(), false, true
+		}
+	}
+	for _, ruleDomain := range rules.allowDomains {
+		if domainMatches(domain, ruleDomain) {
+			return "rule:" + RuleAllowDomain + ":" + ruleDomain, true, true
+		}
+	}
+	for _, ruleDomain := range rules.blockDomains {
+		if domainMatches(domain, ruleDomain) {
+			return "rule:" + RuleBlockDomain + ":" + ruleDomain, false, true
+		}
+	}
+	return "", false, false
+}
+
+// =============================================================================
+// HELPERS
+// =============================================================================
+
+func fetchEmailRules(ctx context.Context, userID int) ([]EmailRule, error) {
+	rows, err := database.DB.Query(
+		ctx,
+		`SELECT id, kind, pattern FROM email_rules WHERE user_id = $1 ORDER BY id`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := []EmailRule{}
+	for rows.Next() {
+		var rule EmailRule
+		if err := rows.Scan(&rule.ID, &rule.Kind, &rule.Pattern); err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, rows.Err()
+}
+
+func normalizeRule(req CreateEmailRuleRequest) (EmailRule, error) {
+	rule := EmailRule{Kind: strings.TrimSpace(req.Kind), Pattern: strings.TrimSpace(req.Pattern)}
+
+	if rule.Pattern == "" {
+		return EmailRule{}, errors.New("Pattern is required")
+	}
+	if len(rule.Pattern) > 255 {
+		return EmailRule{}, errors.New("Pattern cannot exceed 255 characters")
+	}
+
+	switch rule.Kind {
+	case RuleAllowDomain, RuleBlockDomain:
+		rule.Pattern = strings.TrimPrefix(strings.ToLower(rule.Pattern), "@")
+		if !strings.Contains(rule.Pattern, ".") || strings.ContainsAny(rule.Pattern, "@ ") {
+			return EmailRule{}, errors.New("Invalid domain")
+		}
+	case RuleBlockLocalPattern:
+		if _, err := regexp.Compile(rule.Pattern); err != nil {
+			return EmailRule{}, errors.New("Invalid pattern")
+		}
+	default:
+		return EmailRule{}, errors.New("Unknown rule kind")
+	}
+
+	return rule, nil
+}
+
+// domainMatches is true for the rule's domain and any of its subdomains
+func domainMatches(domain, ruleDomain string) bool {
+	return domain == ruleDomain || strings.HasSuffix(domain, "."+ruleDomain)
+}
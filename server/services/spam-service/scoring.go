@@ -0,0 +1,197 @@
+package spamservice
+
+import (
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sync/atomic"
+)
+
+//go:embed data/scoring_rules.json
+var defaultScoringRules embed.FS
+
+// ScoringRule is one check's entry in the rules file
+type ScoringRule struct {
+	Weight      float64 `json:"weight"`
+	Enabled     *bool   `json:"enabled,omitempty"`   // defaults to true
+	Threshold   float64 `json:"threshold,omitempty"` // for checks that flag above a score
+	Description string  `json:"description,omitempty"`
+}
+
+// Ruleset holds the weights of every check and the suggestion thresholds.
+// Checks missing from it still flag but contribute nothing
+type Ruleset struct {
+	Version    string `json:"version"`
+	Thresholds struct {
+		Review float64 `json:"review"`
+		Block  float64 `json:"block"`
+	} `json:"thresholds"`
+	Rules map[string]ScoringRule `json:"rules"`
+}
+
+// RuleContribution explains one flag's share of the risk score
+type RuleContribution struct {
+	Rule   string  `json:"rule"`
+	Flag   string  `json:"flag"`
+	Weight float64 `json:"weight"`
+}
+
+var scoringRules atomic.Pointer[Ruleset]
+
+// scoringRulesPath is SCORING_RULES_PATH, a JSON rules file
+var scoringRulesPath string
+
+func init() {
+	data, err := defaultScoringRules.ReadFile("data/scoring_rules.json")
+	if err != nil {
+		log.Fatal("Failed to read default scoring rules:", err)
+	}
+	ruleset, err := parseRuleset(data)
+	if err != nil {
+		log.Fatal("Invalid default scoring rules:", err)
+	}
+	scoringRules.Store(ruleset)
+}
+
+// InitScoringRules loads SCORING_RULES_PATH when set and watches it for
+// changes. Without it the embedded defaults stay in use
+func InitScoringRules() error {
+	scoringRulesPath = os.Getenv("SCORING_RULES_PATH")
+	if scoringRulesPath == "" {
+		return nil
+	}
+
+	if err := ReloadScoringRules(); err != nil {
+		return err
+	}
+
+	go watchPath(scoringRulesPath, ReloadScoringRules, "scoring rules")
+	return nil
+}
+
+// ReloadScoringRules re-reads the rules file. An invalid file leaves the
+// current rules active
+func ReloadScoringRules() error {
+	if scoringRulesPath == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(scoringRulesPath)
+	if err != nil {
+		return fmt.Errorf("loading %s: %w", scoringRulesPath, err)
+	}
+	ruleset, err := parseRuleset(data)
+	if err != nil {
+		return fmt.Errorf("loading %s: %w", scoringRulesPath, err)
+	}
+
+	scoringRules.Store(ruleset)
+	log.Printf("Loaded %d scoring rules from %s (version %s)", len(ruleset.Rules), scoringRulesPath, ruleset.Version)
+	return nil
+}
+
+func parseRuleset(data []byte) (*Ruleset, error) {
+	var ruleset Ruleset
+	if err := json.Unmarshal(data, &ruleset); err != nil {
+		return nil, err
+	}
+
+	review, block := ruleset.Thresholds.Review, ruleset.Thresholds.Block
+	if review <= 0 || block > 1 || review > block {
+		return nil, fmt.Errorf("thresholds must satisfy 0 < review <= block <= 1")
+	}
+	for name, rule := range ruleset.Rules {
+		if math.IsNaN(rule.Weight) || rule.Weight < -1 || rule.Weight > 1 {
+			return nil, fmt.Errorf("rule %s: weight must be between -1 and 1", name)
+		}
+		if rule.Threshold < 0 || rule.Threshold > 1 {
+			return nil, fmt.Errorf("rule %s: threshold must be between 0 and 1", name)
+		}
+	}
+
+	// Unversioned files are versioned by content
+	if ruleset.Version == "" {
+		hash := sha256.Sum256(data)
+		ruleset.Version = hex.EncodeToString(hash[:])[:12]
+	}
+
+	return &ruleset, nil
+}
+
+func (r *Ruleset) enabled(rule string) bool {
+	entry, ok := r.Rules[rule]
+	return !ok || entry.Enabled == nil || *entry.Enabled
+}
+
+// =============================================================================
+// SCORING
+// =============================================================================
+
+// scorer adds flags to a result under one ruleset, so a reload mid-check
+// can't mix two versions
+type scorer struct {
+	ruleset *Ruleset
+	result  *EmailCheckResult
+}
+
+func newScorer(result *EmailCheckResult) scorer {
+	ruleset := scoringRules.Load()
+	result.RulesetVersion = ruleset.Version
+	return scorer{ruleset: ruleset, result: result}
+}
+
+// add flags the result with the rule, or rule:detail, and adds its weight.
+// Disabled rules are skipped entirely
+func (s scorer) add(rule, detail string) {
+	if !s.ruleset.enabled(rule) {
+		return
+	}
+
+	flag := rule
+	if detail != "" {
+		flag = rule + ":" + detail
+	}
+	weight := s.ruleset.Rules[rule].Weight
+
+	s.result.Flags = append(s.result.Flags, flag)
+	s.result.Breakdown = append(s.result.Breakdown, RuleContribution{Rule: rule, Flag: flag, Weight: weight})
+	s.result.RiskScore += weight
+}
+
+// wants reports whether any of the rules would count, so checks that cost a
+// lookup can be skipped when all their rules are disabled
+func (s scorer) wants(rules ...string) bool {
+	for _, rule := range rules {
+		if s.ruleset.enabled(rule) {
+			return true
+		}
+	}
+	return false
+}
+
+// threshold is the rule's configured cut-off, or fallback when unset
+func (s scorer) threshold(rule string, fallback float64) float64 {
+	if value := s.ruleset.Rules[rule].Threshold; value > 0 {
+		return value
+	}
+	return fallback
+}
+
+// finish clamps the score and derives the suggestion from the thresholds
+func (s scorer) finish() {
+	s.result.RiskScore = math.Round(min(max(s.result.RiskScore, 0), 1)*100) / 100
+
+	switch {
+	case s.result.RiskScore >= s.ruleset.Thresholds.Block:
+		s.result.Suggestion = "block"
+	case s.result.RiskScore >= s.ruleset.Thresholds.Review:
+		s.result.Suggestion = "review"
+	default:
+		s.result.Suggestion = "allow"
+	}
+}
@@ -0,0 +1,352 @@
+package spamservice
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSMTPTimeout = 10 * time.Second
+	smtpMaxHosts       = 2                // MX hosts tried before giving up
+	smtpDomainTTL      = 6 * time.Hour    // how long catch-all behavior is remembered
+	smtpFailureTTL     = 15 * time.Minute // back off from domains that refuse probes
+	smtpMaxDomains     = 10000
+)
+
+// Probe outcomes
+const (
+	MailboxExists   = "exists"
+	MailboxNotFound = "not_found"
+	MailboxCatchAll = "catch_all"
+	MailboxUnknown  = "unknown" // greylisted, refused or unreachable
+)
+
+// SMTPDialer opens the connection to an MX host. Swap it with SetSMTPDialer to
+// probe a local stub server
+type SMTPDialer func(ctx context.Context, host string) (net.Conn, error)
+
+var smtpDialer SMTPDialer = dialMX
+
+// ErrMXNotPublic is returned for MX hosts that only resolve to loopback,
+// private or link-local addresses. Anyone controlling a domain's DNS picks its
+// MX, so probing those would let callers reach the server's own network
+var ErrMXNotPublic = errors.New("mx host has no public address")
+
+// cgnatPrefix is shared address space (RFC 6598), private in all but name
+var cgnatPrefix = netip.MustParsePrefix("100.64.0.0/10")
+
+// dialMX resolves the host itself and connects to the first public address,
+// so the address checked is the one dialed
+func dialMX(ctx context.Context, host string) (net.Conn, error) {
+	addrs, err := lookupHostAddrs(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	var dialer net.Dialer
+	for _, addr := range addrs {
+		if !isPublicAddr(addr) {
+			continue
+		}
+		return dialer.DialContext(ctx, "tcp", netip.AddrPortFrom(addr, 25).String())
+	}
+	return nil, fmt.Errorf("%w: %s", ErrMXNotPublic, host)
+}
+
+// isPublicAddr rejects loopback, private, ULA, link-local, CGNAT, multicast
+// and unspecified addresses
+func isPublicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.IsValid() &&
+		!addr.IsLoopback() &&
+		!addr.IsPrivate() &&
+		!addr.IsLinkLocalUnicast() &&
+		!addr.IsLinkLocalMulticast() &&
+		!addr.IsInterfaceLocalMulticast() &&
+		!addr.IsMulticast() &&
+		!addr.IsUnspecified() &&
+		!cgnatPrefix.Contains(addr) &&
+		!(addr.Is4() && addr.As4()[0] == 0) // 0.0.0.0/8 is "this network"
+}
+
+// SetSMTPDialer replaces how MX hosts are reached
+func SetSMTPDialer(dialer SMTPDialer) {
+	smtpDialer = dialer
+}
+
+// smtpDomainInfo is what a probe taught us about a domain as a whole
+type smtpDomainInfo struct {
+	catchAll  bool
+	failed    bool
+	expiresAt time.Time
+}
+
+var (
+	smtpDomainsMu sync.Mutex
+	smtpDomains   = make(map[string]smtpDomainInfo)
+)
+
+// enhancedStatusRegex matches an RFC 3463 enhanced status code at the start of
+// a reply, e.g. 5.1.1
+var enhancedStatusRegex = regexp.MustCompile(`^([245])\.(\d{1,3})\.(\d{1,3})\b`)
+
+// rcptReply is how an MX answered RCPT TO
+type rcptReply int
+
+const (
+	rcptAccepted       rcptReply = iota
+	rcptNoMailbox                // 5.1.x about the recipient: the address doesn't exist
+	rcptRejected                 // permanent, but without saying why
+	rcptPolicyRejected           // 5.7.x and other permanent codes not about the mailbox
+	rcptTempFailed               // greylisting and other 4xx
+)
+
+// probeMailbox asks the domain's MX whether it would accept mail for the
+// address, stopping at RCPT TO so nothing is ever delivered. A random address
+// is probed in the same session to spot catch-all domains, which accept
+// everything and so can't confirm anything
+func probeMailbox(ctx context.Context, email, domain string, mxHosts []string) (string, error) {
+	helo, err := smtpHeloName()
+	if err != nil {
+		return MailboxUnknown, err
+	}
+
+	if info, ok := cachedSMTPDomain(domain); ok {
+		if info.failed {
+			return MailboxUnknown, errors.New("domain recently refused probes")
+		}
+		if info.catchAll {
+			return MailboxCatchAll, nil
+		}
+	}
+
+	var lastErr error
+	for _, host := range mxHosts[:min(len(mxHosts), smtpMaxHosts)] {
+		status, catchAll, err := probeHost(ctx, host, helo, email, domain)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		if catchAll != nil {
+			rememberSMTPDomain(domain, smtpDomainInfo{catchAll: *catchAll, expiresAt: time.Now().Add(smtpDomainTTL)})
+			if *catchAll {
+				return MailboxCatchAll, nil
+			}
+		}
+		return status, nil
+	}
+
+	rememberSMTPDomain(domain, smtpDomainInfo{failed: true, expiresAt: time.Now().Add(smtpFailureTTL)})
+	return MailboxUnknown, lastErr
+}
+
+// probeHost runs one session. The random address is probed whatever the real
+// one got, since a server that rejects both the same way is refusing the
+// probe rather than the mailbox. catchAll is nil when that couldn't be told
+func probeHost(ctx context.Context, host, helo, email, domain string) (string, *bool, error) {
+	timeout := defaultSMTPTimeout
+	if value, err := time.ParseDuration(os.Getenv("SMTP_PROBE_TIMEOUT")); err == nil && value > 0 {
+		timeout = value
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	conn, err := smtpDialer(ctx, host)
+	if err != nil {
+		return "", nil, err
+	}
+	defer conn.Close()
+
+	// net/smtp has no context support, so the deadline bounds the whole session
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return "", nil, err
+	}
+	defer client.Close()
+
+	from := smtpProbeFrom(helo)
+	if err := client.Hello(helo); err != nil {
+		return "", nil, err
+	}
+	if err := client.Mail(from); err != nil {
+		return "", nil, err
+	}
+
+	realErr := client.Rcpt(email)
+	real, err := classifyRcpt(realErr)
+	if err != nil {
+		return "", nil, err
+	}
+	if real == rcptPolicyRejected || real == rcptTempFailed {
+		client.Quit()
+		return "", nil, fmt.Errorf("rcpt refused: %w", realErr)
+	}
+
+	random, randomErr, randomOK := probeRandomRecipient(client, from, domain)
+	client.Quit()
+
+	switch real {
+	case rcptAccepted:
+		if !randomOK {
+			return MailboxExists, nil, nil
+		}
+		catchAll := random == rcptAccepted
+		return MailboxExists, &catchAll, nil
+	case rcptNoMailbox:
+		return MailboxNotFound, new(bool), nil
+	default:
+		// A bare 550 only means the mailbox is missing if a made-up address
+		// is answered differently
+		if randomOK && (random == rcptAccepted || replyCode(randomErr) != replyCode(realErr)) {
+			return MailboxNotFound, new(bool), nil
+		}
+		return "", nil, fmt.Errorf("rcpt rejected without a mailbox status: %w", realErr)
+	}
+}
+
+// probeRandomRecipient asks about a made-up address in the same session. ok is
+// false when the session couldn't be reset for it
+func probeRandomRecipient(client *smtp.Client, from, domain string) (reply rcptReply, rcptErr error, ok bool) {
+	probe, err := randomLocalPart()
+	if err != nil || client.Reset() != nil || client.Mail(from) != nil {
+		return 0, nil, false
+	}
+	rcptErr = client.Rcpt(probe + "@" + domain)
+	reply, err = classifyRcpt(rcptErr)
+	if err != nil {
+		return 0, nil, false
+	}
+	return reply, rcptErr, true
+}
+
+// classifyRcpt reads RCPT TO's reply. Permanent failures are sorted by their
+// enhanced status code: only 5.1.x about the recipient says the mailbox is
+// missing, 5.7.x and the rest are blocks on the prober. Errors other than a
+// reply, such as a dropped connection, are returned
+func classifyRcpt(err error) (rcptReply, error) {
+	if err == nil {
+		return rcptAccepted, nil
+	}
+
+	var protoErr *textproto.Error
+	if !errors.As(err, &protoErr) {
+		return 0, err
+	}
+
+	switch {
+	case protoErr.Code >= 400 && protoErr.Code < 500:
+		return rcptTempFailed, nil
+	case protoErr.Code < 500 || protoErr.Code >= 600:
+		return 0, fmt.Errorf("unexpected rcpt reply: %d %s", protoErr.Code, protoErr.Msg)
+	}
+
+	match := enhancedStatusRegex.FindStringSubmatch(protoErr.Msg)
+	if match == nil {
+		return rcptRejected, nil
+	}
+	// 5.1.7 and 5.1.8 are about the sender's address, not the recipient
+	if match[2] == "1" && match[3] != "7" && match[3] != "8" {
+		return rcptNoMailbox, nil
+	}
+	return rcptPolicyRejected, nil
+}
+
+// replyCode is the SMTP code of a reply error, 0 for anything else
+func replyCode(err error) int {
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		return protoErr.Code
+	}
+	return 0
+}
+
+func cachedSMTPDomain(domain string) (smtpDomainInfo, bool) {
+	smtpDomainsMu.Lock()
+	defer smtpDomainsMu.Unlock()
+
+	info, ok := smtpDomains[domain]
+	if !ok || time.Now().After(info.expiresAt) {
+		return smtpDomainInfo{}, false
+	}
+	return info, true
+}
+
+func rememberSMTPDomain(domain string, info smtpDomainInfo) {
+	smtpDomainsMu.Lock()
+	defer smtpDomainsMu.Unlock()
+
+	if len(smtpDomains) >= smtpMaxDomains {
+		now := time.Now()
+		for key, entry := range smtpDomains {
+			if now.After(entry.expiresAt) {
+				delete(smtpDomains, key)
+			}
+		}
+	}
+	if len(smtpDomains) < smtpMaxDomains {
+		smtpDomains[domain] = info
+	}
+}
+
+func randomLocalPart() (string, error) {
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "katanaid-probe-" + hex.EncodeToString(b), nil
+}
+
+// smtpHeloName is SMTP_PROBE_HELO, or the host's name when that is fully
+// qualified. It should resolve back to the probing host, and many MXs refuse
+// anything that isn't a public FQDN, so probing is off without one
+func smtpHeloName() (string, error) {
+	name := os.Getenv("SMTP_PROBE_HELO")
+	if name == "" {
+		hostname, err := os.Hostname()
+		if err != nil || !isFQDN(hostname) {
+			return "", errors.New("SMTP_PROBE_HELO is not set and the hostname is not fully qualified")
+		}
+		return hostname, nil
+	}
+	if !isFQDN(name) {
+		return "", fmt.Errorf("SMTP_PROBE_HELO %q is not a fully qualified domain name", name)
+	}
+	return name, nil
+}
+
+// isFQDN accepts hostnames of two or more labels that aren't local-only
+func isFQDN(name string) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if validateDomain(name) != nil {
+		return false
+	}
+	for _, local := range []string{".localhost", ".local", ".localdomain", ".internal", ".lan"} {
+		if strings.HasSuffix(name, local) {
+			return false
+		}
+	}
+	return true
+}
+
+func smtpProbeFrom(helo string) string {
+	if from := os.Getenv("SMTP_PROBE_FROM"); from != "" {
+		return from
+	}
+	return "probe@" + helo
+}
@@ -0,0 +1,244 @@
+package spamservice
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// stubSMTPServer answers one SMTP session per dial. rcpt gives the reply line
+// to RCPT TO for an address; the probe's random address is passed as "random"
+type stubSMTPServer struct {
+	rcpt func(address string) string
+
+	mu    sync.Mutex
+	helo  string
+	dials int
+}
+
+func (s *stubSMTPServer) dial(ctx context.Context, host string) (net.Conn, error) {
+	s.mu.Lock()
+	s.dials++
+	s.mu.Unlock()
+
+	client, server := net.Pipe()
+	go s.serve(server)
+	return client, nil
+}
+
+// seen returns the HELO name and dial count so far
+func (s *stubSMTPServer) seen() (string, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.helo, s.dials
+}
+
+func (s *stubSMTPServer) serve(conn net.Conn) {
+	defer conn.Close()
+	text := textproto.NewConn(conn)
+	text.PrintfLine("220 mx.example.com ESMTP stub")
+
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			s.mu.Lock()
+			s.helo = arg
+			s.mu.Unlock()
+			text.PrintfLine("250 mx.example.com")
+		case "MAIL", "RSET":
+			text.PrintfLine("250 2.0.0 OK")
+		case "RCPT":
+			address := strings.Trim(strings.TrimPrefix(arg, "TO:"), "<>")
+			if strings.HasPrefix(address, "katanaid-probe-") {
+				address = "random"
+			}
+			text.PrintfLine("%s", s.rcpt(address))
+		case "QUIT":
+			text.PrintfLine("221 2.0.0 Bye")
+			return
+		default:
+			text.PrintfLine("502 5.5.2 Command not recognized")
+		}
+	}
+}
+
+// useStubSMTPServer routes probes to the stub for the length of the test
+func useStubSMTPServer(t *testing.T, rcpt func(address string) string) *stubSMTPServer {
+	t.Helper()
+	t.Setenv("SMTP_PROBE_HELO", "probe.katanaid.test.example.com")
+	stub := &stubSMTPServer{rcpt: rcpt}
+	SetSMTPDialer(stub.dial)
+	t.Cleanup(func() { SetSMTPDialer(dialMX) })
+	return stub
+}
+
+func TestProbeMailbox(t *testing.T) {
+	tests := []struct {
+		name    string
+		real    string
+		random  string
+		want    string
+		wantErr bool
+	}{
+		{"exists", "250 2.1.5 OK", "550 5.1.1 User unknown", MailboxExists, false},
+		{"catch-all", "250 2.1.5 OK", "250 2.1.5 OK", MailboxCatchAll, false},
+		{"no such user", "550 5.1.1 User unknown", "550 5.1.1 User unknown", MailboxNotFound, false},
+		{"mailbox unavailable", "553 5.1.3 Bad destination mailbox address", "550 5.1.1 User unknown", MailboxNotFound, false},
+		{"blocked by policy", "550 5.7.1 Client host rejected", "550 5.7.1 Client host rejected", MailboxUnknown, true},
+		{"blocklisted on both", "550 Service unavailable; client host blocked", "550 Service unavailable; client host blocked", MailboxUnknown, true},
+		{"bare rejection only for the real address", "550 No such user here", "250 OK", MailboxNotFound, false},
+		{"greylisted", "450 4.2.0 Greylisted, try again later", "450 4.2.0 Greylisted, try again later", MailboxUnknown, true},
+		{"sender rejected", "550 5.1.8 Bad sender domain", "550 5.1.8 Bad sender domain", MailboxUnknown, true},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useStubSMTPServer(t, func(address string) string {
+				if address == "random" {
+					return tt.random
+				}
+				return tt.real
+			})
+
+			// The domain cache is shared, so every case gets its own domain
+			domain := "stub" + string(rune('a'+i)) + ".example.com"
+			got, err := probeMailbox(context.Background(), "someone@"+domain, domain, []string{"mx." + domain})
+			if got != tt.want {
+				t.Errorf("status = %q, want %q", got, tt.want)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, want error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestProbeMailboxSendsConfiguredHelo(t *testing.T) {
+	stub := useStubSMTPServer(t, func(address string) string {
+		return "250 2.1.5 OK"
+	})
+	t.Setenv("SMTP_PROBE_HELO", "mail.katanaid.example.com")
+
+	domain := "helo.example.com"
+	if _, err := probeMailbox(context.Background(), "someone@"+domain, domain, []string{"mx." + domain}); err != nil {
+		t.Fatal(err)
+	}
+	if helo, _ := stub.seen(); helo != "mail.katanaid.example.com" {
+		t.Errorf("HELO = %q, want mail.katanaid.example.com", helo)
+	}
+}
+
+func TestProbeMailboxRequiresFQDNHelo(t *testing.T) {
+	for _, helo := range []string{"localhost", "probe", "probe.local", "192.0.2.1"} {
+		t.Run(helo, func(t *testing.T) {
+			stub := useStubSMTPServer(t, func(address string) string {
+				return "250 2.1.5 OK"
+			})
+			t.Setenv("SMTP_PROBE_HELO", helo)
+
+			domain := "nofqdn.example.com"
+			got, err := probeMailbox(context.Background(), "someone@"+domain, domain, []string{"mx." + domain})
+			if got != MailboxUnknown || err == nil {
+				t.Errorf("probeMailbox = %q, %v, want unknown with an error", got, err)
+			}
+			if _, dials := stub.seen(); dials != 0 {
+				t.Errorf("dialed %d times, want none", dials)
+			}
+		})
+	}
+}
+
+func TestDialMXRefusesNonPublicAddresses(t *testing.T) {
+	server := newFakeDNSServer(t, func(query dnsmessage.Message, tcp bool) dnsmessage.Message {
+		response := reply(query, dnsmessage.RCodeSuccess)
+		if query.Questions[0].Type == dnsmessage.TypeA {
+			response.Answers = []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{Name: query.Questions[0].Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 300},
+				Body:   &dnsmessage.AResource{A: [4]byte{127, 0, 0, 1}},
+			}}
+		}
+		return response
+	})
+	SetResolver(NewCachingResolver([]string{server.addr}, time.Second))
+	t.Cleanup(func() { SetResolver(NewCachingResolver(systemNameservers(), defaultDNSTimeout)) })
+
+	for _, host := range []string{"mx.internal.example.com", "10.0.0.5", "169.254.169.254", "[::1]"} {
+		if _, err := dialMX(context.Background(), host); !errors.Is(err, ErrMXNotPublic) {
+			t.Errorf("dialMX(%q) err = %v, want ErrMXNotPublic", host, err)
+		}
+	}
+}
+
+func TestIsPublicAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"192.0.2.10", true},
+		{"8.8.8.8", true},
+		{"2001:4860:4860::8888", true},
+		{"127.0.0.1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"0.1.2.3", false},
+		{"::1", false},
+		{"::", false},
+		{"fd00::1", false},
+		{"fe80::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"224.0.0.1", false},
+	}
+
+	for _, tt := range tests {
+		if got := isPublicAddr(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("isPublicAddr(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestClassifyRcpt(t *testing.T) {
+	tests := []struct {
+		err  error
+		want rcptReply
+	}{
+		{nil, rcptAccepted},
+		{&textproto.Error{Code: 550, Msg: "5.1.1 <a@example.com>: Recipient address rejected"}, rcptNoMailbox},
+		{&textproto.Error{Code: 551, Msg: "5.1.6 User has moved"}, rcptNoMailbox},
+		{&textproto.Error{Code: 550, Msg: "5.7.1 Relaying denied"}, rcptPolicyRejected},
+		{&textproto.Error{Code: 554, Msg: "5.7.606 Access denied, banned sending IP"}, rcptPolicyRejected},
+		{&textproto.Error{Code: 553, Msg: "5.1.7 Bad sender mailbox syntax"}, rcptPolicyRejected},
+		{&textproto.Error{Code: 550, Msg: "Requested action not taken"}, rcptRejected},
+		{&textproto.Error{Code: 451, Msg: "4.7.1 Please try again later"}, rcptTempFailed},
+	}
+
+	for _, tt := range tests {
+		got, err := classifyRcpt(tt.err)
+		if err != nil {
+			t.Fatalf("classifyRcpt(%v) error: %v", tt.err, err)
+		}
+		if got != tt.want {
+			t.Errorf("classifyRcpt(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+
+	if _, err := classifyRcpt(errors.New("connection reset")); err == nil {
+		t.Error("classifyRcpt(non-reply error) returned no error")
+	}
+}
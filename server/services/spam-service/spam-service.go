@@ -1,62 +1,58 @@
 package spamservice
 
 import (
-	"bufio"
-	"bytes"
 	"context"
 	"crypto/sha256"
-	"embed"
 	"encoding/hex"
 	"encoding/json"
 	"log"
-	"net"
 	"net/http"
-	"regexp"
 	"strings"
-	"unicode"
+	"sync"
 
 	"katanaid/database"
+	"katanaid/middleware"
 	"katanaid/models"
 	"katanaid/util"
 )
 
-//go:embed data/disposable_email_blocklist.conf
-var blocklist embed.FS
-
-var disposableDomains map[string]bool
-
-func init() {
-	disposableDomains = make(map[string]bool)
-
-	data, err := blocklist.ReadFile("data/disposable_email_blocklist.conf")
-	if err != nil {
-		log.Print("Failed to load disposable email blocklist:", err)
-	}
-
-	scanner := bufio.NewScanner(bytes.NewReader(data))
-	for scanner.Scan() {
-		domain := strings.TrimSpace(scanner.Text())
-		if domain != "" && !strings.HasPrefix(domain, "#") {
-			disposableDomains[strings.ToLower(domain)] = true
-		}
-	}
-
-	log.Printf("Loaded %d disposable email domains", len(disposableDomains))
-}
-
 type EmailCheckRequest struct {
-	Email string `json:"email"`
+	Email     string `json:"email"`
+	SMTPCheck bool   `json:"smtp_check"` // opt in to probing the mailbox over SMTP
 }
 
 type BulkEmailCheckRequest struct {
-	Emails []string `json:"emails"`
+	Emails    []string `json:"emails"`
+	SMTPCheck bool     `json:"smtp_check"`
+}
+
+// checkOptions carries per-request settings into each check
+type checkOptions struct {
+	rules     *customerRules
+	smtpCheck bool
+	skipDNS   bool // no MX, sender policy or mailbox checks
+	offline   bool // no database, so no history or reputation checks
 }
 
 type EmailCheckResult struct {
-	Email      string   `json:"email"`
-	RiskScore  float64  `json:"risk_score"`
-	Flags      []string `json:"flags"`
-	Suggestion string   `json:"suggestion"`
+	Email       string   `json:"email"`
+	RiskScore   float64  `json:"risk_score"`
+	Flags       []string `json:"flags"`
+	Suggestion  string   `json:"suggestion"`
+	DidYouMean  string   `json:"did_you_mean,omitempty"` // corrected address when the domain looks mistyped
+	FormatError string   `json:"format_error,omitempty"` // why an address failed validation
+
+	// Audit trail: each flag's contribution and the ruleset that scored it
+	Breakdown      []RuleContribution `json:"breakdown"`
+	RulesetVersion string             `json:"ruleset_version"`
+
+	// How machine-generated the local part looks, from 0 to 1
+	RandomnessScore float64 `json:"randomness_score"`
+
+	// Classification, filled in for any well-formed address
+	RoleAccount  bool   `json:"role_account"`
+	FreeProvider bool   `json:"free_provider"`
+	DomainType   string `json:"domain_type,omitempty"`
 }
 
 type BulkEmailCheckResponse struct {
@@ -71,21 +67,8 @@ type BulkSummary struct {
 	Risky      int `json:"risky"`
 }
 
-var emailRegex = regexp.MustCompile(`^[^\s@]+@[^\s@]+\.[^\s@]+$`)
-
-var typosquatPatterns = map[string]string{
-	"gmial.com":  "gmail.com",
-	"gmal.com":   "gmail.com",
-	"gnail.com":  "gmail.com",
-	"gamil.com":  "gmail.com",
-	"gmail.co":   "gmail.com",
-	"yahooo.com": "yahoo.com",
-	"yaho.com":   "yahoo.com",
-	"hotmal.com": "hotmail.com",
-	"hotmai.com": "hotmail.com",
-	"outloo.com": "outlook.com",
-	"outlok.com": "outlook.com",
-}
+// bulkWorkers bounds concurrent checks, and so DNS queries, per bulk request
+const bulkWorkers = 10
 
 func CheckEmail(w http.ResponseWriter, r *http.Request) {
 	var req EmailCheckRequest
@@ -102,7 +85,18 @@ func CheckEmail(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	result := analyzeEmail(email)
+	if !smtpCheckAllowed(w, r, req.SMTPCheck) {
+		return
+	}
+
+	rules, err := rulesForRequest(r)
+	if err != nil {
+		log.Print("Error loading email rules:", err)
+		util.WriteJSON(w, http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to load rules"})
+		return
+	}
+
+	result := analyzeEmail(r.Context(), email, checkOptions{rules: rules, smtpCheck: req.SMTPCheck})
 
 	// Log the check to database
 	go logSpamCheck(email, result)
@@ -129,20 +123,31 @@ func CheckEmailBulk(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	results := make([]EmailCheckResult, 0, len(req.Emails))
-	summary := BulkSummary{Total: len(req.Emails)}
+	if !smtpCheckAllowed(w, r, req.SMTPCheck) {
+		return
+	}
+
+	rules, err := rulesForRequest(r)
+	if err != nil {
+		log.Print("Error loading email rules:", err)
+		util.WriteJSON(w, http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to load rules"})
+		return
+	}
 
+	emails := make([]string, 0, len(req.Emails))
 	for _, email := range req.Emails {
 		email = strings.ToLower(strings.TrimSpace(email))
-		if email == "" {
-			continue
+		if email != "" {
+			emails = append(emails, email)
 		}
+	}
 
-		result := analyzeEmail(email)
-		results = append(results, result)
+	results := analyzeEmails(r.Context(), emails, checkOptions{rules: rules, smtpCheck: req.SMTPCheck})
+	summary := BulkSummary{Total: len(req.Emails)}
 
+	for i, result := range results {
 		// Log each check to database
-		go logSpamCheck(email, result)
+		go logSpamCheck(emails[i], result)
 
 		switch result.Suggestion {
 		case "allow":
@@ -160,126 +165,209 @@ func CheckEmailBulk(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-func analyzeEmail(email string) EmailCheckResult {
+// smtpCheckAllowed refuses SMTP probing to anonymous callers, since every
+// probe is an outbound connection made on their behalf
+func smtpCheckAllowed(w http.ResponseWriter, r *http.Request, smtpCheck bool) bool {
+	if !smtpCheck {
+		return true
+	}
+	if _, ok := middleware.GetAPIKeyFromContext(r.Context()); !ok {
+		util.WriteJSON(w, http.StatusUnauthorized, models.ErrorResponse{Error: "API key required for smtp_check"})
+		return false
+	}
+	return true
+}
+
+// analyzeEmails checks a batch on a bounded pool of workers, since each check
+// may wait on DNS. Results keep the order of emails
+func analyzeEmails(ctx context.Context, emails []string, opts checkOptions) []EmailCheckResult {
+	results := make([]EmailCheckResult, len(emails))
+	jobs := make(chan int)
+
+	var wg sync.WaitGroup
+	for range min(bulkWorkers, len(emails)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i] = analyzeEmail(ctx, emails[i], opts)
+			}
+		}()
+	}
+
+	for i := range emails {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	return results
+}
+
+func analyzeEmail(ctx context.Context, email string, opts checkOptions) EmailCheckResult {
 	result := EmailCheckResult{
 		Email:     email,
 		RiskScore: 0.0,
 		Flags:     []string{},
+		Breakdown: []RuleContribution{},
 	}
+	score := newScorer(&result)
 
 	// Validate format
-	if !emailRegex.MatchString(email) {
+	address, err := parseEmailAddress(email)
+	if err != nil {
 		result.Flags = append(result.Flags, "invalid_format")
+		result.Breakdown = append(result.Breakdown, RuleContribution{Rule: "invalid_format", Flag: "invalid_format", Weight: 1.0})
+		result.FormatError = err.Error()
 		result.RiskScore = 1.0
 		result.Suggestion = "block"
 		return result
 	}
 
-	parts := strings.Split(email, "@")
-	localPart := parts[0]
-	domain := parts[1]
+	// Lookups use the ASCII (punycode) form of the domain
+	localPart := address.LocalPart
+	domain := address.Domain
+	email = localPart + "@" + domain
+
+	result.RoleAccount = isRoleAccount(localPart)
+	result.FreeProvider = isFreeProvider(domain)
+	result.DomainType = classifyDomain(domain)
+
+	// Customer rules take precedence over the built-in heuristics
+	if flag, allow, matched := opts.rules.match(localPart, domain); matched {
+		result.Flags = append(result.Flags, flag)
+		if allow {
+			result.Suggestion = "allow"
+		} else {
+			result.RiskScore = 1.0
+			result.Suggestion = "block"
+		}
+		result.Breakdown = append(result.Breakdown, RuleContribution{Rule: "customer_rule", Flag: flag, Weight: result.RiskScore})
+		return result
+	}
 
 	// Check disposable domain
-	if disposableDomains[strings.ToLower(domain)] {
-		result.Flags = append(result.Flags, "disposable")
-		result.RiskScore += 0.8
+	if result.DomainType == DomainDisposable {
+		score.add("disposable", "")
+	}
+
+	// Check internationalized domains drawn to look like another
+	if domain != address.UnicodeDomain {
+		score.add("idn", "")
+		if isMixedScript(address.UnicodeDomain) {
+			score.add("mixed_script", "")
+		}
+	}
+	homograph := detectHomograph(address.UnicodeDomain)
+	if homograph != "" {
+		score.add("homograph", homograph)
+		result.DidYouMean = localPart + "@" + homograph
 	}
 
 	// Check typosquatting
-	if correctDomain, isTypo := typosquatPatterns[domain]; isTypo {
-		result.Flags = append(result.Flags, "typosquat:"+correctDomain)
-		result.RiskScore += 0.6
+	if correctDomain := detectTyposquat(domain); correctDomain != "" && homograph == "" {
+		score.add("typosquat", correctDomain)
+		result.DidYouMean = localPart + "@" + correctDomain
+	}
+
+	// Role mailboxes are shared, so they rarely belong to a genuine signup
+	if result.RoleAccount {
+		score.add("role_account", "")
 	}
 
 	// Check plus addressing
 	if strings.Contains(localPart, "+") {
-		result.Flags = append(result.Flags, "plus_addressing")
-		result.RiskScore += 0.2
+		score.add("plus_addressing", "")
 	}
 
-	// Check random pattern
-	if hasRandomPattern(localPart) {
-		result.Flags = append(result.Flags, "random_pattern")
-		result.RiskScore += 0.4
+	// Check other spellings of the same mailbox
+	if !opts.offline && score.wants("canonical_registered", "canonical_seen") {
+		registered, seen := checkCanonicalHistory(ctx, email)
+		if registered {
+			score.add("canonical_registered", "")
+		}
+		if seen > 0 {
+			score.add("canonical_seen", "")
+		}
 	}
 
-	// Check numeric heavy
-	if isNumericHeavy(localPart) {
-		result.Flags = append(result.Flags, "numeric_heavy")
-		result.RiskScore += 0.3
+	// Check what past checks say about the domain. The big providers are
+	// checked constantly, so their history says nothing
+	if !opts.offline && (result.DomainType == DomainCorporate || result.DomainType == DomainEducation || result.DomainType == DomainGovernment) &&
+		score.wants("new_domain", "high_velocity_domain") {
+		reputation, err := domainReputation(ctx, domain)
+		if err != nil {
+			log.Print("Error loading domain reputation:", err)
+		} else {
+			if reputation.NewDomain {
+				score.add("new_domain", "")
+			}
+			if reputation.HighVelocity {
+				score.add("high_velocity_domain", "")
+			}
+		}
 	}
 
-	// Check MX records
-	if !hasMXRecords(domain) {
-		result.Flags = append(result.Flags, "no_mx_record")
-		result.RiskScore += 0.5
+	// Check for machine-generated local parts
+	result.RandomnessScore = randomnessScore(localPart)
+	if result.RandomnessScore >= score.threshold("random_pattern", defaultRandomnessThreshold) {
+		score.add("random_pattern", "")
 	}
 
-	// Cap at 1.0
-	if result.RiskScore > 1.0 {
-		result.RiskScore = 1.0
+	if opts.skipDNS {
+		score.finish()
+		return result
 	}
 
-	// Set suggestion
+	// Check MX records
+	// A lookup that fails or times out says nothing about the domain
+	mxHosts, err := lookupMX(ctx, domain)
 	switch {
-	case result.RiskScore >= 0.7:
-		result.Suggestion = "block"
-	case result.RiskScore >= 0.3:
-		result.Suggestion = "review"
+	case err != nil:
+		log.Printf("MX lookup for %s failed: %v", domain, err)
+		score.add("mx_lookup_failed", "")
+	case isNullMX(mxHosts):
+		score.add("null_mx", "")
+	case len(mxHosts) == 0:
+		score.add("no_mx_record", "")
 	default:
-		result.Suggestion = "allow"
-	}
-
-	return result
-}
-
-func hasMXRecords(domain string) bool {
-	mxRecords, err := net.LookupMX(domain)
-	return err == nil && len(mxRecords) > 0
-}
-
-func hasRandomPattern(localPart string) bool {
-	cleaned := strings.ReplaceAll(localPart, ".", "")
-	cleaned = strings.ReplaceAll(cleaned, "_", "")
-	cleaned = strings.ReplaceAll(cleaned, "-", "")
-
-	if len(cleaned) < 8 {
-		return false
-	}
-
-	vowels := "aeiou"
-	consecutiveConsonants := 0
-	maxConsecutive := 0
-
-	for _, char := range strings.ToLower(cleaned) {
-		if unicode.IsLetter(char) {
-			if !strings.ContainsRune(vowels, char) {
-				consecutiveConsonants++
-				if consecutiveConsonants > maxConsecutive {
-					maxConsecutive = consecutiveConsonants
-				}
-			} else {
-				consecutiveConsonants = 0
+		// Throwaway and parked domains rarely bother with sender policies
+		if score.wants("no_spf", "no_dmarc", "disposable_mx") {
+			config := checkDomainConfig(ctx, domain, mxHosts)
+			if config.missingSPF {
+				score.add("no_spf", "")
+			}
+			if config.missingDMARC {
+				score.add("no_dmarc", "")
 			}
+			if config.disposableMX != "" && result.DomainType != DomainDisposable {
+				score.add("disposable_mx", config.disposableMX)
+			}
+		}
+
+		if opts.smtpCheck {
+			checkMailbox(ctx, score, email, domain, mxHosts)
 		}
 	}
 
-	return maxConsecutive >= 5
+	score.finish()
+	return result
 }
 
-func isNumericHeavy(localPart string) bool {
-	if len(localPart) < 6 {
-		return false
-	}
-
-	digitCount := 0
-	for _, char := range localPart {
-		if unicode.IsDigit(char) {
-			digitCount++
-		}
+// checkMailbox adds the outcome of an SMTP probe
+func checkMailbox(ctx context.Context, score scorer, email, domain string, mxHosts []string) {
+	status, err := probeMailbox(ctx, email, domain, mxHosts)
+	switch status {
+	case MailboxExists:
+		score.add("mailbox_exists", "")
+	case MailboxNotFound:
+		score.add("mailbox_not_found", "")
+	case MailboxCatchAll:
+		score.add("catch_all", "")
+	default:
+		log.Printf("SMTP probe for %s failed: %v", domain, err)
+		score.add("smtp_error", "")
 	}
-
-	return float64(digitCount)/float64(len(localPart)) > 0.6
 }
 
 func HashEmail(email string) string {
@@ -288,19 +376,22 @@ func HashEmail(email string) string {
 }
 
 func logSpamCheck(email string, result EmailCheckResult) {
-	parts := strings.Split(email, "@")
+	// Log the ASCII form so IDN domains aggregate under one name
 	domain := ""
-	if len(parts) == 2 {
-		domain = parts[1]
+	if address, err := parseEmailAddress(email); err == nil {
+		domain = address.Domain
 	}
 
 	_, err := database.DB.Exec(
 		context.Background(),
-		`INSERT INTO spam_checks (email_hash, domain, risk_score, flags) VALUES ($1, $2, $3, $4)`,
+		`INSERT INTO spam_checks (email_hash, domain, risk_score, flags, canonical_hash, suggestion)
+		VALUES ($1, $2, $3, $4, $5, $6)`,
 		HashEmail(email),
 		domain,
 		result.RiskScore,
 		result.Flags,
+		CanonicalEmailHash(email),
+		result.Suggestion,
 	)
 	if err != nil {
 		log.Print("Error logging spam check:", err)
@@ -0,0 +1,219 @@
+package spamservice
+
+import "strings"
+
+// Typosquat matching thresholds, in weighted edits
+const (
+	typoMaxDistance     = 1.0
+	typoMaxDistanceLong = 2.0 // for provider names of typoLongName letters or more
+	typoLongName        = 8
+	typoMinName         = 6   // shorter names are an edit from everyday words (live/life, zoho/soho), so only known typos match
+	adjacentKeyCost     = 0.5 // substituting a neighbouring key is the likeliest slip
+)
+
+// knownTypoDomains are typo domains registered to catch mistyped mail. They
+// are flagged even where the TLD is a real one, which a provider's name on
+// any other real TLD never is
+var knownTypoDomains = map[string]string{
+	"gmial.com":  "gmail.com",
+	"gmal.com":   "gmail.com",
+	"gnail.com":  "gmail.com",
+	"gamil.com":  "gmail.com",
+	"gmai.com":   "gmail.com",
+	"gmaill.com": "gmail.com",
+	"gmali.com":  "gmail.com",
+	"gmil.com":   "gmail.com",
+	"gmail.co":   "gmail.com",
+	"gmail.cm":   "gmail.com",
+	"gmail.om":   "gmail.com",
+	"yahooo.com": "yahoo.com",
+	"yaho.com":   "yahoo.com",
+	"yahoo.co":   "yahoo.com",
+	"yahoo.cm":   "yahoo.com",
+	"hotmal.com": "hotmail.com",
+	"hotmai.com": "hotmail.com",
+	"hotmail.co": "hotmail.com",
+	"hotmail.cm": "hotmail.com",
+	"outloo.com": "outlook.com",
+	"outlok.com": "outlook.com",
+	"outlook.co": "outlook.com",
+	"outlook.cm": "outlook.com",
+	"icloud.co":  "icloud.com",
+	"icloud.cm":  "icloud.com",
+}
+
+// genericTLDs are the generic TLDs a mailbox domain is likely to use. Every
+// two-letter TLD is taken to be a real country code
+var genericTLDs = map[string]bool{
+	"com": true, "net": true, "org": true, "edu": true, "gov": true, "mil": true,
+	"int": true, "info": true, "biz": true, "name": true, "pro": true, "mobi": true,
+	"app": true, "dev": true, "email": true, "mail": true, "online": true, "xyz": true,
+}
+
+var providerSet = func() map[string]struct{} {
+	set := make(map[string]struct{}, len(popularProviders))
+	for _, provider := range popularProviders {
+		set[provider] = struct{}{}
+	}
+	return set
+}()
+
+// qwertyRows is used to derive which keys are adjacent
+var qwertyRows = []string{
+	"1234567890",
+	"qwertyuiop",
+	"asdfghjkl",
+	"zxcvbnm",
+}
+
+var adjacentKeys = func() map[[2]rune]bool {
+	adjacent := make(map[[2]rune]bool)
+	link := func(a, b rune) {
+		adjacent[[2]rune{a, b}] = true
+		adjacent[[2]rune{b, a}] = true
+	}
+
+	for row, keys := range qwertyRows {
+		runes := []rune(keys)
+		for i, key := range runes {
+			if i+1 < len(runes) {
+				link(key, runes[i+1])
+			}
+			// Rows are staggered, so a key touches two keys on the row below
+			if row+1 < len(qwertyRows) {
+				below := []rune(qwertyRows[row+1])
+				for _, j := range []int{i - 1, i} {
+					if j >= 0 && j < len(below) {
+						link(key, below[j])
+					}
+				}
+			}
+		}
+	}
+	return adjacent
+}()
+
+// detectTyposquat returns the provider a domain most likely misspells, or ""
+// when it is a provider itself or close to none. Names are compared with
+// keyboard slips discounted; TLDs only match exactly or as a typo that isn't
+// itself a real TLD, so hotmail.es or att.com are left alone
+func detectTyposquat(domain string) string {
+	if provider, ok := knownTypoDomains[domain]; ok {
+		return provider
+	}
+	if _, ok := providerSet[domain]; ok {
+		return ""
+	}
+
+	name, tld := splitTLD(domain)
+	best := ""
+	bestDistance := 0.0
+
+	for _, provider := range popularProviders {
+		providerName, providerTLD := splitTLD(provider)
+
+		// Right name, mistyped TLD: gmail.con, yahoo.cmo
+		if name == providerName {
+			if isTLDTypo(tld, providerTLD) {
+				return provider
+			}
+			continue
+		}
+
+		if tld != providerTLD || len(providerName) < typoMinName {
+			continue
+		}
+
+		limit := typoMaxDistance
+		if len(providerName) >= typoLongName {
+			limit = typoMaxDistanceLong
+		}
+
+		distance := editDistance(name, providerName)
+		if distance <= limit && (best == "" || distance < bestDistance) {
+			best = provider
+			bestDistance = distance
+		}
+	}
+
+	return best
+}
+
+// splitTLD splits at the last dot, or the second to last for two-level
+// suffixes like co.uk
+func splitTLD(domain string) (name, tld string) {
+	dot := strings.LastIndexByte(domain, '.')
+	if dot < 0 {
+		return domain, ""
+	}
+	if prev := strings.LastIndexByte(domain[:dot], '.'); prev >= 0 && len(domain[dot+1:]) == 2 {
+		if second := domain[prev+1 : dot]; second == "co" || second == "com" {
+			dot = prev
+		}
+	}
+	return domain[:dot], domain[dot+1:]
+}
+
+// isTLDTypo reports whether tld is one plain edit from the provider's and not
+// a TLD anyone could hold a mailbox under
+func isTLDTypo(tld, providerTLD string) bool {
+	if tld == providerTLD || isRealTLD(tld) {
+		return false
+	}
+	// No keyboard discount here: a neighbouring key usually spells another
+	// real TLD
+	return osaDistance(tld, providerTLD, 1) <= typoMaxDistance
+}
+
+// isRealTLD is true for two-letter country codes, known generic TLDs and
+// two-level suffixes like co.uk
+func isRealTLD(tld string) bool {
+	return len(tld) == 2 || genericTLDs[tld] || strings.Contains(tld, ".")
+}
+
+// editDistance is the optimal string alignment variant of Damerau-Levenshtein:
+// insertions, deletions, substitutions and adjacent transpositions each cost
+// one edit, except substitutions between neighbouring keys which cost less
+func editDistance(a, b string) float64 {
+	return osaDistance(a, b, adjacentKeyCost)
+}
+
+// osaDistance is editDistance with the cost of a neighbouring-key substitution
+// given
+func osaDistance(a, b string, adjacentCost float64) float64 {
+	s, t := []rune(a), []rune(b)
+
+	// Three rows are enough for transpositions
+	prev2 := make([]float64, len(t)+1)
+	prev := make([]float64, len(t)+1)
+	curr := make([]float64, len(t)+1)
+	for j := range prev {
+		prev[j] = float64(j)
+	}
+
+	for i := 1; i <= len(s); i++ {
+		curr[0] = float64(i)
+		for j := 1; j <= len(t); j++ {
+			substitution := 0.0
+			if s[i-1] != t[j-1] {
+				substitution = 1.0
+				if adjacentKeys[[2]rune{s[i-1], t[j-1]}] {
+					substitution = adjacentCost
+				}
+			}
+
+			curr[j] = min(
+				prev[j]+1,              // deletion
+				curr[j-1]+1,            // insertion
+				prev[j-1]+substitution, // substitution
+			)
+
+			if i > 1 && j > 1 && s[i-1] == t[j-2] && s[i-2] == t[j-1] {
+				curr[j] = min(curr[j], prev2[j-2]+1) // transposition
+			}
+		}
+		prev2, prev, curr = prev, curr, prev2
+	}
+
+	return prev[len(t)]
+}
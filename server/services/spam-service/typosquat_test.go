@@ -0,0 +1,127 @@
+package spamservice
+
+import "testing"
+
+func TestDetectTyposquat(t *testing.T) {
+	tests := []struct {
+		domain string
+		want   string
+	}{
+		// Misspelled names
+		{"gmai.com", "gmail.com"},
+		{"gmial.com", "gmail.com"},
+		{"gnail.com", "gmail.com"},
+		{"gmaill.com", "gmail.com"},
+		{"yahooo.com", "yahoo.com"},
+		{"hotmial.com", "hotmail.com"},
+		{"hotmaik.com", "hotmail.com"},
+		{"outlok.com", "outlook.com"},
+		{"outlool.com", "outlook.com"},
+		{"protonmial.com", "protonmail.com"},
+		{"hotmial.co.uk", "hotmail.co.uk"},
+
+		// Mistyped TLDs that aren't real ones
+		{"gmail.con", "gmail.com"},
+		{"gmail.cmo", "gmail.com"},
+		{"gmail.ocm", "gmail.com"},
+		{"yahoo.comm", "yahoo.com"},
+		{"comcast.nte", "comcast.net"},
+
+		// Registered typo domains on real TLDs
+		{"gmail.co", "gmail.com"},
+		{"outlook.cm", "outlook.com"},
+		{"hotmail.co", "hotmail.com"},
+
+		// Providers themselves
+		{"gmail.com", ""},
+		{"hotmail.co.uk", ""},
+		{"gmx.de", ""},
+		{"mail.com", ""},
+
+		// Provider names on other real TLDs
+		{"hotmail.es", ""},
+		{"yahoo.es", ""},
+		{"outlook.es", ""},
+		{"gmx.fr", ""},
+		{"gmx.at", ""},
+		{"att.com", ""},
+		{"verizon.com", ""},
+		{"comcast.com", ""},
+		{"163.net", ""},
+		{"mail.de", ""},
+		{"yahoo.com.au", ""},
+
+		// Real domains one edit from a short provider name
+		{"life.com", ""},
+		{"line.com", ""},
+		{"hive.com", ""},
+		{"give.com", ""},
+		{"lime.com", ""},
+		{"main.com", ""},
+		{"mall.com", ""},
+		{"mails.com", ""},
+		{"gail.com", ""},
+		{"soho.com", ""},
+		{"never.com", ""},
+		{"tree.fr", ""},
+
+		// Unrelated domains
+		{"example.com", ""},
+		{"company.org", ""},
+		{"gmail.example", ""},
+		{"university.edu", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.domain, func(t *testing.T) {
+			if got := detectTyposquat(tt.domain); got != tt.want {
+				t.Errorf("detectTyposquat(%q) = %q, want %q", tt.domain, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want float64
+	}{
+		{"gmail", "gmail", 0},
+		{"gmai", "gmail", 1},
+		{"gmial", "gmail", 1},
+		{"gnail", "gmail", adjacentKeyCost},
+		{"gqail", "gmail", 1},
+		{"hotmial", "hotmail", 1},
+		{"yaho", "yahoo", 1},
+		{"outlook", "ourliok", 2 * adjacentKeyCost},
+	}
+
+	for _, tt := range tests {
+		if got := editDistance(tt.a, tt.b); got != tt.want {
+			t.Errorf("editDistance(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestIsTLDTypo(t *testing.T) {
+	tests := []struct {
+		tld, providerTLD string
+		want             bool
+	}{
+		{"con", "com", true},
+		{"cmo", "com", true},
+		{"vom", "com", true},
+		{"com", "com", false},
+		{"net", "com", false}, // real gTLD
+		{"de", "es", false},   // real ccTLD, adjacent keys
+		{"co", "com", false},  // real ccTLD
+		{"co.uk", "com", false},
+		{"cnet", "com", false}, // two edits
+	}
+
+	for _, tt := range tests {
+		if got := isTLDTypo(tt.tld, tt.providerTLD); got != tt.want {
+			t.Errorf("isTLDTypo(%q, %q) = %v, want %v", tt.tld, tt.providerTLD, got, tt.want)
+		}
+	}
+}
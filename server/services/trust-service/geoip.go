@@ -0,0 +1,234 @@
+package trustservice
+
+import (
+	"context"
+	"log"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	_ "time/tzdata" // browser timezones are compared even where the host has no zoneinfo
+
+	"katanaid/database"
+
+	"github.com/oschwald/maxminddb-golang/v2"
+)
+
+// maxTimezoneDrift is how far apart, in UTC offset, the browser's timezone and
+// the IP's may be before they count as a mismatch
+const maxTimezoneDrift = 3 * time.Hour
+
+// GeoInfo is what the GeoIP databases know about an address
+type GeoInfo struct {
+	Country   string `json:"country,omitempty"` // ISO 3166-1 alpha-2
+	Continent string `json:"continent,omitempty"`
+	Region    string `json:"region,omitempty"` // ISO 3166-2 subdivision code, without the country
+	City      string `json:"city,omitempty"`
+	Timezone  string `json:"timezone,omitempty"`
+	ASN       uint   `json:"asn,omitempty"`
+	ASOrg     string `json:"as_org,omitempty"`
+}
+
+// cityRecord and asnRecord pick the fields used from GeoLite2/GeoIP2 City and
+// ASN records
+type cityRecord struct {
+	Continent struct {
+		Code string `maxminddb:"code"`
+	} `maxminddb:"continent"`
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	Subdivisions []struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"subdivisions"`
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+	Location struct {
+		TimeZone string `maxminddb:"time_zone"`
+	} `maxminddb:"location"`
+}
+
+type asnRecord struct {
+	Number       uint   `maxminddb:"autonomous_system_number"`
+	Organization string `maxminddb:"autonomous_system_organization"`
+}
+
+// The readers mmap their files, so a reload waits for lookups in progress
+// before closing the old ones
+var (
+	geoMu     sync.RWMutex
+	geoCity   *maxminddb.Reader
+	geoASN    *maxminddb.Reader
+	geoPaths  [2]string // GEOIP_CITY_DB, GEOIP_ASN_DB
+	geoLoaded bool
+)
+
+// InitGeoIP opens GEOIP_CITY_DB and GEOIP_ASN_DB, either of which may be unset
+func InitGeoIP() error {
+	geoPaths = [2]string{os.Getenv("GEOIP_CITY_DB"), os.Getenv("GEOIP_ASN_DB")}
+	return ReloadGeoIP()
+}
+
+// ReloadGeoIP reopens the databases, for when they are replaced by an updated
+// download. If either fails to open the current ones stay in use
+func ReloadGeoIP() error {
+	city, err := openGeoDB(geoPaths[0])
+	if err != nil {
+		return err
+	}
+	asn, err := openGeoDB(geoPaths[1])
+	if err != nil {
+		if city != nil {
+			city.Close()
+		}
+		return err
+	}
+
+	geoMu.Lock()
+	oldCity, oldASN := geoCity, geoASN
+	geoCity, geoASN = city, asn
+	geoLoaded = city != nil || asn != nil
+	geoMu.Unlock()
+
+	if oldCity != nil {
+		oldCity.Close()
+	}
+	if oldASN != nil {
+		oldASN.Close()
+	}
+
+	if geoLoaded {
+		log.Printf("Loaded GeoIP databases (city: %q, asn: %q)", geoPaths[0], geoPaths[1])
+	}
+	return nil
+}
+
+func openGeoDB(path string) (*maxminddb.Reader, error) {
+	if path == "" {
+		return nil, nil
+	}
+	return maxminddb.Open(path)
+}
+
+// LookupGeo returns what the databases know about the IP, or nil when no
+// database is loaded or the address isn't in them
+func LookupGeo(ip string) *GeoInfo {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return nil
+	}
+	addr = addr.Unmap()
+
+	geoMu.RLock()
+	defer geoMu.RUnlock()
+	if !geoLoaded {
+		return nil
+	}
+
+	info := GeoInfo{}
+	found := false
+
+	if geoCity != nil {
+		var record cityRecord
+		result := geoCity.Lookup(addr)
+		if result.Found() && result.Decode(&record) == nil {
+			found = true
+			info.Country = record.Country.ISOCode
+			info.Continent = record.Continent.Code
+			if len(record.Subdivisions) > 0 {
+				info.Region = record.Subdivisions[0].ISOCode
+			}
+			info.City = record.City.Names["en"]
+			info.Timezone = record.Location.TimeZone
+		}
+	}
+
+	if geoASN != nil {
+		var record asnRecord
+		result := geoASN.Lookup(addr)
+		if result.Found() && result.Decode(&record) == nil {
+			found = true
+			info.ASN = record.Number
+			info.ASOrg = record.Organization
+		}
+	}
+
+	if !found {
+		return nil
+	}
+	return &info
+}
+
+// RecordLogin stores where a successful login came from
+func RecordLogin(userID int, ip, method string) {
+	geo := geoOrEmpty(LookupGeo(ip))
+
+	_, err := database.DB.Exec(
+		context.Background(),
+		`INSERT INTO login_events (user_id, method, ip_address, country, region, asn, as_org)
+		VALUES ($1, $2, $3, NULLIF($4, ''), NULLIF($5, ''), NULLIF($6, 0), NULLIF($7, ''))`,
+		userID, method, ip, geo.Country, geo.Region, int64(geo.ASN), geo.ASOrg,
+	)
+	if err != nil {
+		log.Print("Error recording login:", err)
+	}
+}
+
+// =============================================================================
+// TIMEZONE CONSISTENCY
+// =============================================================================
+
+// timezonePrefixContinents maps IANA zone areas to the continent codes the
+// GeoIP databases use
+var timezonePrefixContinents = map[string][]string{
+	"America":    {"NA", "SA"},
+	"Europe":     {"EU"},
+	"Asia":       {"AS"},
+	"Africa":     {"AF"},
+	"Australia":  {"OC"},
+	"Pacific":    {"OC"},
+	"Antarctica": {"AN"},
+}
+
+// timezoneMismatch reports whether the browser's timezone is implausible for
+// the IP's location: more than maxTimezoneDrift apart, or on another continent
+// when the location has no timezone
+func timezoneMismatch(browserTimezone string, geo *GeoInfo) bool {
+	return timezoneMismatchAt(browserTimezone, geo, time.Now())
+}
+
+// timezoneMismatchAt compares the offsets in force at now, since daylight
+// saving moves them
+func timezoneMismatchAt(browserTimezone string, geo *GeoInfo, now time.Time) bool {
+	if browserTimezone == "" || geo == nil {
+		return false
+	}
+
+	if geo.Timezone != "" {
+		browserLoc, err1 := time.LoadLocation(browserTimezone)
+		geoLoc, err2 := time.LoadLocation(geo.Timezone)
+		if err1 == nil && err2 == nil {
+			_, browserOffset := now.In(browserLoc).Zone()
+			_, geoOffset := now.In(geoLoc).Zone()
+			drift := (time.Duration(browserOffset-geoOffset) * time.Second).Abs()
+			if drift > 12*time.Hour {
+				drift = 24*time.Hour - drift // neighbours across the date line
+			}
+			return drift > maxTimezoneDrift
+		}
+	}
+
+	area, _, ok := strings.Cut(browserTimezone, "/")
+	continents, known := timezonePrefixContinents[area]
+	if !ok || !known || geo.Continent == "" {
+		return false
+	}
+	for _, continent := range continents {
+		if continent == geo.Continent {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,59 @@
+package trustservice
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata" // the cases need zone data wherever the tests run
+)
+
+func TestTimezoneMismatch(t *testing.T) {
+	winter := time.Date(2026, time.January, 15, 12, 0, 0, 0, time.UTC)
+	summer := time.Date(2026, time.July, 15, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		browser string
+		geo     *GeoInfo
+		at      time.Time
+		want    bool
+	}{
+		// The request's example: a New York browser on an Asian connection
+		{"new york from tokyo", "America/New_York", &GeoInfo{Continent: "AS", Timezone: "Asia/Tokyo"}, winter, true},
+		{"new york from shanghai", "America/New_York", &GeoInfo{Continent: "AS", Timezone: "Asia/Shanghai"}, summer, true},
+		{"new york from london", "America/New_York", &GeoInfo{Continent: "EU", Timezone: "Europe/London"}, winter, true},
+
+		// Neighbouring zones
+		{"new york from chicago", "America/New_York", &GeoInfo{Continent: "NA", Timezone: "America/Chicago"}, winter, false},
+		{"new york from denver", "America/New_York", &GeoInfo{Continent: "NA", Timezone: "America/Denver"}, summer, false},
+		{"london from paris", "Europe/London", &GeoInfo{Continent: "EU", Timezone: "Europe/Paris"}, summer, false},
+		{"same zone", "Asia/Tokyo", &GeoInfo{Continent: "AS", Timezone: "Asia/Tokyo"}, winter, false},
+
+		// Neighbours across the date line, a day apart on the clock
+		{"tonga from american samoa", "Pacific/Tongatapu", &GeoInfo{Continent: "OC", Timezone: "Pacific/Pago_Pago"}, winter, false},
+		{"kiribati from hawaii", "Pacific/Kiritimati", &GeoInfo{Continent: "OC", Timezone: "Pacific/Honolulu"}, summer, false},
+
+		// London and Sao Paulo are 3 hours apart in winter, 4 in summer
+		{"london from sao paulo in winter", "Europe/London", &GeoInfo{Continent: "SA", Timezone: "America/Sao_Paulo"}, winter, false},
+		{"london from sao paulo in summer", "Europe/London", &GeoInfo{Continent: "SA", Timezone: "America/Sao_Paulo"}, summer, true},
+
+		// Continent fallback when the location has no usable timezone
+		{"continent mismatch", "America/New_York", &GeoInfo{Continent: "AS"}, winter, true},
+		{"continent match", "America/Sao_Paulo", &GeoInfo{Continent: "SA"}, winter, false},
+		{"unknown browser zone", "America/Nowhere", &GeoInfo{Continent: "AS", Timezone: "Asia/Tokyo"}, winter, true},
+		{"area without a continent", "Indian/Maldives", &GeoInfo{Continent: "AS"}, winter, false},
+		{"no area", "UTC", &GeoInfo{Continent: "AS"}, winter, false},
+		{"no continent", "America/New_York", &GeoInfo{Country: "JP"}, winter, false},
+
+		// Nothing to compare
+		{"no browser zone", "", &GeoInfo{Continent: "AS", Timezone: "Asia/Tokyo"}, winter, false},
+		{"no location", "America/New_York", nil, winter, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := timezoneMismatchAt(tt.browser, tt.geo, tt.at); got != tt.want {
+				t.Errorf("timezoneMismatchAt(%q, %+v) = %v, want %v", tt.browser, tt.geo, got, tt.want)
+			}
+		})
+	}
+}
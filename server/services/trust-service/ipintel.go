@@ -0,0 +1,190 @@
+package trustservice
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// IP list categories, one subdirectory of IP_INTEL_DIR each
+const (
+	IPCategoryHosting = "hosting" // cloud and datacenter ranges
+	IPCategoryVPN     = "vpn"
+	IPCategoryTor     = "tor" // exit nodes
+	IPCategoryDeny    = "deny"
+)
+
+var ipCategories = []string{IPCategoryHosting, IPCategoryVPN, IPCategoryTor, IPCategoryDeny}
+
+// IPMatch names a list that contains an address
+type IPMatch struct {
+	Category string
+	List     string
+}
+
+// ipIntel is every loaded list, swapped as a whole on reload
+type ipIntel struct {
+	v4, v6 *prefixNode
+}
+
+var ipIntelData atomic.Pointer[ipIntel]
+
+// ipIntelDir is IP_INTEL_DIR, laid out as <category>/<list>.txt
+var ipIntelDir string
+
+func init() {
+	ipIntelData.Store(&ipIntel{v4: &prefixNode{}, v6: &prefixNode{}})
+}
+
+// InitIPIntel loads IP_INTEL_DIR when set. Each file holds one CIDR or address
+// per line, with # comments; its name without the extension names the list
+func InitIPIntel() error {
+	ipIntelDir = os.Getenv("IP_INTEL_DIR")
+	return ReloadIPIntel()
+}
+
+// ReloadIPIntel re-reads every list. A file that fails to parse leaves the
+// current lists active
+func ReloadIPIntel() error {
+	if ipIntelDir == "" {
+		return nil
+	}
+
+	intel := &ipIntel{v4: &prefixNode{}, v6: &prefixNode{}}
+	total := 0
+
+	for _, category := range ipCategories {
+		paths, err := filepath.Glob(filepath.Join(ipIntelDir, category, "*"))
+		if err != nil {
+			return err
+		}
+		for _, path := range paths {
+			if info, err := os.Stat(path); err != nil || info.IsDir() {
+				continue
+			}
+			list := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+			count, err := intel.loadList(path, IPMatch{Category: category, List: list})
+			if err != nil {
+				return err
+			}
+			total += count
+		}
+	}
+
+	ipIntelData.Store(intel)
+	log.Printf("Loaded %d IP intelligence ranges from %s", total, ipIntelDir)
+	return nil
+}
+
+func (intel *ipIntel) loadList(path string, match IPMatch) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	count := 0
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		entry := scanner.Text()
+		if i := strings.IndexByte(entry, '#'); i >= 0 {
+			entry = entry[:i]
+		}
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		prefix, err := parsePrefix(entry)
+		if err != nil {
+			return 0, fmt.Errorf("%s:%d: invalid range %q", path, line, entry)
+		}
+		root := intel.v6
+		if prefix.Addr().Is4() {
+			root = intel.v4
+		}
+		root.insert(prefix, match)
+		count++
+	}
+	return count, scanner.Err()
+}
+
+// lookupIP returns every list containing the address, broadest range first
+func lookupIP(ip string) []IPMatch {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return nil
+	}
+	addr = addr.Unmap()
+
+	intel := ipIntelData.Load()
+	root := intel.v6
+	if addr.Is4() {
+		root = intel.v4
+	}
+	return root.lookup(addr)
+}
+
+// =============================================================================
+// PREFIX TRIE
+// =============================================================================
+
+// prefixNode is a binary trie keyed on address bits. A node holds the lists
+// of the ranges that end at its depth
+type prefixNode struct {
+	children [2]*prefixNode
+	matches  []IPMatch
+}
+
+func (n *prefixNode) insert(prefix netip.Prefix, match IPMatch) {
+	bytes := prefix.Addr().AsSlice()
+	node := n
+	for i := 0; i < prefix.Bits(); i++ {
+		bit := bytes[i/8] >> (7 - i%8) & 1
+		if node.children[bit] == nil {
+			node.children[bit] = &prefixNode{}
+		}
+		node = node.children[bit]
+	}
+	for _, existing := range node.matches {
+		if existing == match {
+			return
+		}
+	}
+	node.matches = append(node.matches, match)
+}
+
+func (n *prefixNode) lookup(addr netip.Addr) []IPMatch {
+	bytes := addr.AsSlice()
+	matches := []IPMatch{}
+	node := n
+	for i := 0; node != nil; i++ {
+		matches = append(matches, node.matches...)
+		if i == len(bytes)*8 {
+			break
+		}
+		node = node.children[bytes[i/8]>>(7-i%8)&1]
+	}
+	return matches
+}
+
+// parsePrefix accepts a CIDR or a bare address, as a single-address range
+func parsePrefix(entry string) (netip.Prefix, error) {
+	if prefix, err := netip.ParsePrefix(entry); err == nil {
+		if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+			return netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96).Masked(), nil
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(entry)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
@@ -0,0 +1,147 @@
+package trustservice
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestPrefixTrie(t *testing.T) {
+	hosting := IPMatch{Category: IPCategoryHosting, List: "cloud"}
+	vpn := IPMatch{Category: IPCategoryVPN, List: "vpn"}
+	tor := IPMatch{Category: IPCategoryTor, List: "exits"}
+
+	v4, v6 := &prefixNode{}, &prefixNode{}
+	for _, entry := range []struct {
+		prefix string
+		match  IPMatch
+	}{
+		{"198.51.100.0/24", hosting},
+		{"198.51.100.128/25", vpn}, // nested inside the /24
+		{"198.51.100.200/32", tor},
+		{"198.51.100.0/24", hosting}, // duplicate
+		{"0.0.0.0/0", IPMatch{Category: IPCategoryDeny, List: "all"}},
+		{"2001:db8::/32", hosting},
+		{"2001:db8:1::/48", vpn},
+	} {
+		prefix := netip.MustParsePrefix(entry.prefix)
+		root := v6
+		if prefix.Addr().Is4() {
+			root = v4
+		}
+		root.insert(prefix, entry.match)
+	}
+	deny := IPMatch{Category: IPCategoryDeny, List: "all"}
+
+	tests := []struct {
+		addr string
+		want []IPMatch
+	}{
+		{"198.51.100.1", []IPMatch{deny, hosting}},
+		{"198.51.100.129", []IPMatch{deny, hosting, vpn}},
+		{"198.51.100.200", []IPMatch{deny, hosting, vpn, tor}},
+		{"198.51.101.1", []IPMatch{deny}},
+		{"2001:db8::1", []IPMatch{hosting}},
+		{"2001:db8:1::1", []IPMatch{hosting, vpn}},
+		{"2001:db9::1", []IPMatch{}},
+	}
+
+	for _, tt := range tests {
+		addr := netip.MustParseAddr(tt.addr)
+		root := v6
+		if addr.Is4() {
+			root = v4
+		}
+		if got := root.lookup(addr); !slices.Equal(got, tt.want) {
+			t.Errorf("lookup(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestParsePrefix(t *testing.T) {
+	tests := []struct {
+		entry string
+		want  string
+	}{
+		{"198.51.100.7/24", "198.51.100.0/24"},
+		{"198.51.100.7", "198.51.100.7/32"},
+		{"2001:db8::1", "2001:db8::1/128"},
+		{"2001:db8::1/32", "2001:db8::/32"},
+		{"::ffff:198.51.100.7", "198.51.100.7/32"},
+		{"::ffff:198.51.100.0/120", "198.51.100.0/24"},
+	}
+
+	for _, tt := range tests {
+		got, err := parsePrefix(tt.entry)
+		if err != nil {
+			t.Errorf("parsePrefix(%q) error: %v", tt.entry, err)
+			continue
+		}
+		if got.String() != tt.want {
+			t.Errorf("parsePrefix(%q) = %s, want %s", tt.entry, got, tt.want)
+		}
+	}
+
+	if _, err := parsePrefix("not-a-range"); err == nil {
+		t.Error("parsePrefix accepted garbage")
+	}
+}
+
+func TestReloadIPIntel(t *testing.T) {
+	dir := t.TempDir()
+	writeList := func(category, name, content string) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Join(dir, category), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, category, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	previous := ipIntelData.Load()
+	t.Cleanup(func() {
+		ipIntelData.Store(previous)
+		ipIntelDir = ""
+	})
+	t.Setenv("IP_INTEL_DIR", dir)
+
+	writeList(IPCategoryTor, "exits.txt", "# Tor exits\n198.51.100.7\n")
+	writeList(IPCategoryHosting, "cloud.txt", "203.0.113.0/24 # a cloud\n2001:db8::/32\n")
+	if err := InitIPIntel(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := matchedLists("198.51.100.7", IPCategoryTor); !slices.Equal(got, []string{"exits"}) {
+		t.Errorf("tor lists = %v, want [exits]", got)
+	}
+	if got := matchedLists("::ffff:203.0.113.9", IPCategoryHosting); !slices.Equal(got, []string{"cloud"}) {
+		t.Errorf("hosting lists for a mapped address = %v, want [cloud]", got)
+	}
+	if got := matchedLists("2001:db8::5", IPCategoryHosting); !slices.Equal(got, []string{"cloud"}) {
+		t.Errorf("hosting lists for IPv6 = %v, want [cloud]", got)
+	}
+
+	// Reloading picks up edits
+	writeList(IPCategoryTor, "exits.txt", "198.51.100.8\n")
+	if err := ReloadIPIntel(); err != nil {
+		t.Fatal(err)
+	}
+	if got := matchedLists("198.51.100.7", IPCategoryTor); len(got) != 0 {
+		t.Errorf("removed exit still listed in %v", got)
+	}
+	if got := matchedLists("198.51.100.8", IPCategoryTor); !slices.Equal(got, []string{"exits"}) {
+		t.Errorf("added exit lists = %v, want [exits]", got)
+	}
+
+	// A broken file keeps the lists already loaded
+	writeList(IPCategoryVPN, "broken.txt", "198.51.100.0/33\n")
+	if err := ReloadIPIntel(); err == nil {
+		t.Fatal("ReloadIPIntel accepted an invalid range")
+	}
+	if got := matchedLists("198.51.100.8", IPCategoryTor); !slices.Equal(got, []string{"exits"}) {
+		t.Errorf("lists after a failed reload = %v, want [exits]", got)
+	}
+}
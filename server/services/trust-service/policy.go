@@ -0,0 +1,284 @@
+package trustservice
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"slices"
+	"time"
+
+	"katanaid/database"
+	"katanaid/middleware"
+	"katanaid/models"
+	"katanaid/util"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Signal names, as used in policies and responses
+const (
+	SignalFingerprint    = "fingerprint"
+	SignalIPReputation   = "ip_reputation"
+	SignalEmailPattern   = "email_pattern"
+	SignalBrowserSignals = "browser_signals"
+	SignalHosting        = "hosting"
+	SignalVPN            = "vpn"
+	SignalTor            = "tor"
+)
+
+// alwaysEvaluated are the signals scored for every request. The IP list
+// signals are skipped when the IP isn't listed, so they can't carry a policy
+// alone
+var alwaysEvaluated = []string{
+	SignalFingerprint, SignalIPReputation, SignalEmailPattern, SignalBrowserSignals,
+}
+
+// signalOrder is the order signals are checked and reported in
+var signalOrder = []string{
+	SignalFingerprint, SignalIPReputation, SignalEmailPattern, SignalBrowserSignals,
+	SignalHosting, SignalVPN, SignalTor,
+}
+
+// =============================================================================
+// REQ / RES TYPES
+// =============================================================================
+
+// SignalPolicy weighs a signal. For the IP list signals (hosting, vpn, tor)
+// the weight is a penalty: a listed IP scores at most 1 - weight
+type SignalPolicy struct {
+	Weight  float64 `json:"weight"`
+	Enabled bool    `json:"enabled"`
+}
+
+// TrustPolicy decides how signals combine into a score and which scores are
+// blocked or challenged. Version 0 is the built-in default
+type TrustPolicy struct {
+	Version      int                     `json:"version"`
+	Signals      map[string]SignalPolicy `json:"signals"`
+	BlockBelow   float64                 `json:"block_below"`
+	CaptchaBelow float64                 `json:"captcha_below"`
+	CreatedAt    *time.Time              `json:"created_at,omitempty"`
+}
+
+type UpdateTrustPolicyRequest struct {
+	Signals      map[string]SignalPolicy `json:"signals"`
+	BlockBelow   float64                 `json:"block_below"`
+	CaptchaBelow float64                 `json:"captcha_below"`
+}
+
+func defaultTrustPolicy() TrustPolicy {
+	return TrustPolicy{
+		Version: 0,
+		Signals: map[string]SignalPolicy{
+			SignalFingerprint:    {Weight: WeightFingerprint, Enabled: true},
+			SignalIPReputation:   {Weight: WeightIPReputation, Enabled: true},
+			SignalEmailPattern:   {Weight: WeightEmailPattern, Enabled: true},
+			SignalBrowserSignals: {Weight: WeightBrowserSignals, Enabled: true},
+			SignalHosting:        {Weight: WeightHosting, Enabled: true},
+			SignalVPN:            {Weight: WeightVPN, Enabled: true},
+			SignalTor:            {Weight: WeightTor, Enabled: true},
+		},
+		BlockBelow:   DefaultBlockBelow,
+		CaptchaBelow: DefaultCaptchaBelow,
+	}
+}
+
+// =============================================================================
+// HANDLERS
+// =============================================================================
+
+// GetTrustPolicy returns the policy in force for the account
+func GetTrustPolicy(w http.ResponseWriter, r *http.Request) {
+	user, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		util.WriteJSON(w, http.StatusUnauthorized, models.ErrorResponse{Error: "Unauthorized"})
+		return
+	}
+
+	policy, err := loadTrustPolicy(r.Context(), user.UserID)
+	if err != nil {
+		log.Print("Error loading trust policy:", err)
+		util.WriteJSON(w, http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to load policy"})
+		return
+	}
+
+	util.WriteJSON(w, http.StatusOK, policy)
+}
+
+// ListTrustPolicyVersions returns every version, newest first, so past scores
+// can be traced to the policy that produced them
+func ListTrustPolicyVersions(w http.ResponseWriter, r *http.Request) {
+	user, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		util.WriteJSON(w, http.StatusUnauthorized, models.ErrorResponse{Error: "Unauthorized"})
+		return
+	}
+
+	rows, err := database.DB.Query(
+		r.Context(),
+		`SELECT version, signals, block_below, captcha_below, created_at
+		FROM trust_policies WHERE user_id = $1 ORDER BY version DESC`,
+		user.UserID,
+	)
+	if err != nil {
+		log.Print("Error listing trust policies:", err)
+		util.WriteJSON(w, http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to list policies"})
+		return
+	}
+	defer rows.Close()
+
+	policies := []TrustPolicy{}
+	for rows.Next() {
+		policy, err := scanTrustPolicy(rows)
+		if err != nil {
+			log.Print("Error scanning trust policy:", err)
+			util.WriteJSON(w, http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to list policies"})
+			return
+		}
+		policies = append(policies, policy)
+	}
+
+	util.WriteJSON(w, http.StatusOK, policies)
+}
+
+// UpdateTrustPolicy stores the policy as a new version. Earlier versions are
+// kept unchanged. The response carries the thresholds as stored
+func UpdateTrustPolicy(w http.ResponseWriter, r *http.Request) {
+	user, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		util.WriteJSON(w, http.StatusUnauthorized, models.ErrorResponse{Error: "Unauthorized"})
+		return
+	}
+
+	var req UpdateTrustPolicyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		util.WriteJSON(w, http.StatusBadRequest, models.ErrorResponse{Error: "Invalid request"})
+		return
+	}
+
+	policy := TrustPolicy{Signals: req.Signals, BlockBelow: req.BlockBelow, CaptchaBelow: req.CaptchaBelow}
+	if err := validateTrustPolicy(policy); err != nil {
+		util.WriteJSON(w, http.StatusBadRequest, models.ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	signals, err := json.Marshal(policy.Signals)
+	if err != nil {
+		util.WriteJSON(w, http.StatusBadRequest, models.ErrorResponse{Error: "Invalid signals"})
+		return
+	}
+
+	var createdAt time.Time
+	err = database.DB.QueryRow(
+		r.Context(),
+		`INSERT INTO trust_policies (user_id, version, signals, block_below, captcha_below)
+		SELECT $1, COALESCE(MAX(version), 0) + 1, $2, $3, $4 FROM trust_policies WHERE user_id = $1
+		RETURNING version, block_below, captcha_below, created_at`,
+		user.UserID, signals, policy.BlockBelow, policy.CaptchaBelow,
+	).Scan(&policy.Version, &policy.BlockBelow, &policy.CaptchaBelow, &createdAt)
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+		util.WriteJSON(w, http.StatusConflict, models.ErrorResponse{Error: "Policy was changed concurrently, try again"})
+		return
+	}
+	if err != nil {
+		log.Print("Error saving trust policy:", err)
+		util.WriteJSON(w, http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to save policy"})
+		return
+	}
+	policy.CreatedAt = &createdAt
+
+	util.WriteJSON(w, http.StatusCreated, policy)
+}
+
+// =============================================================================
+// LOADING
+// =============================================================================
+
+// policyForRequest loads the policy of the account behind the request's API
+// key. Anonymous requests get the default
+func policyForRequest(r *http.Request) (TrustPolicy, error) {
+	key, ok := middleware.GetAPIKeyFromContext(r.Context())
+	if !ok {
+		return defaultTrustPolicy(), nil
+	}
+	return loadTrustPolicy(r.Context(), key.UserID)
+}
+
+// loadTrustPolicy returns the account's latest version, or the default when it
+// has never set one
+func loadTrustPolicy(ctx context.Context, userID int) (TrustPolicy, error) {
+	row := database.DB.QueryRow(
+		ctx,
+		`SELECT version, signals, block_below, captcha_below, created_at
+		FROM trust_policies WHERE user_id = $1 ORDER BY version DESC LIMIT 1`,
+		userID,
+	)
+
+	policy, err := scanTrustPolicy(row)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return defaultTrustPolicy(), nil
+	}
+	return policy, err
+}
+
+func scanTrustPolicy(row pgx.Row) (TrustPolicy, error) {
+	var policy TrustPolicy
+	var signals []byte
+	var createdAt time.Time
+
+	if err := row.Scan(&policy.Version, &signals, &policy.BlockBelow, &policy.CaptchaBelow, &createdAt); err != nil {
+		return TrustPolicy{}, err
+	}
+	if err := json.Unmarshal(signals, &policy.Signals); err != nil {
+		return TrustPolicy{}, err
+	}
+	policy.CreatedAt = &createdAt
+	return policy, nil
+}
+
+// =============================================================================
+// HELPERS
+// =============================================================================
+
+func validateTrustPolicy(policy TrustPolicy) error {
+	if len(policy.Signals) == 0 {
+		return errors.New("At least one signal is required")
+	}
+
+	evaluatedWeight := 0.0
+	for name, signal := range policy.Signals {
+		if !isKnownSignal(name) {
+			return fmt.Errorf("Unknown signal %q", name)
+		}
+		if math.IsNaN(signal.Weight) || signal.Weight < 0 || signal.Weight > 1 {
+			return fmt.Errorf("Weight of %s must be between 0 and 1", name)
+		}
+		if signal.Enabled && slices.Contains(alwaysEvaluated, name) {
+			evaluatedWeight += signal.Weight
+		}
+	}
+	if evaluatedWeight == 0 {
+		return errors.New("At least one of fingerprint, ip_reputation, email_pattern or browser_signals must be enabled with a weight")
+	}
+
+	if policy.BlockBelow < 0 || policy.CaptchaBelow > 1 || policy.BlockBelow > policy.CaptchaBelow {
+		return errors.New("Thresholds must satisfy 0 <= block_below <= captcha_below <= 1")
+	}
+	return nil
+}
+
+func isKnownSignal(name string) bool {
+	for _, known := range signalOrder {
+		if name == known {
+			return true
+		}
+	}
+	return false
+}
@@ -6,13 +6,14 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"log"
-	"net"
+	"math"
 	"net/http"
+	"slices"
 	"strings"
-	"time"
 
 	"katanaid/database"
 	"katanaid/models"
+	spamservice "katanaid/services/spam-service"
 	"katanaid/util"
 )
 
@@ -24,13 +25,21 @@ const (
 	// Thresholds
 	MaxSignupsPerIPPerDay      = 5
 	MaxSignupsPerIPPerWeek     = 10
+	MaxSignupsPerPrefixPerDay  = 15 // per /24 or /64
+	MaxSignupsPerPrefixPerWeek = 30
 	SuspiciousFingerprintCount = 3
 
-	// Score weights (total = 1.0)
+	// Default policy: score weights and cut-offs. The IP list weights are
+	// penalties rather than shares: a listed IP scores at most 1 - weight
 	WeightFingerprint    = 0.35
 	WeightIPReputation   = 0.30
 	WeightEmailPattern   = 0.20
 	WeightBrowserSignals = 0.15
+	WeightHosting        = 0.5
+	WeightVPN            = 0.5
+	WeightTor            = 0.9
+	DefaultBlockBelow    = 0.3
+	DefaultCaptchaBelow  = 0.6
 )
 
 // =============================================================================
@@ -62,10 +71,12 @@ type Signal struct {
 }
 
 type TrustScoreResponse struct {
-	Score          float64  `json:"score"`
-	Signals        []Signal `json:"signals"`
-	Recommendation string   `json:"recommendation"`
-	FingerprintID  string   `json:"fingerprint_id"`
+	Score          float64     `json:"score"`
+	Signals        []Signal    `json:"signals"`
+	Recommendation string      `json:"recommendation"`
+	FingerprintID  string      `json:"fingerprint_id"`
+	Policy         TrustPolicy `json:"policy"` // the policy that produced the score
+	Geo            *GeoInfo    `json:"geo,omitempty"`
 }
 
 // =============================================================================
@@ -79,61 +90,69 @@ func CalculateTrustScore(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get client IP
-	ip := getClientIP(r)
+	policy, err := policyForRequest(r)
+	if err != nil {
+		log.Print("Error loading trust policy:", err)
+		util.WriteJSON(w, http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to load policy"})
+		return
+	}
+
+	// Get client IP and where it is
+	ip := util.ClientIP(r)
+	geo := LookupGeo(ip)
 
 	// Generate fingerprint hash
 	fingerprintHash := generateFingerprintHash(req.Fingerprint)
 
-	// Calculate individual signal scores
-	signals := []Signal{}
-	totalScore := 0.0
-
-	// 1. Fingerprint uniqueness check
-	fpSignal := checkFingerprintHistory(fingerprintHash)
-	signals = append(signals, fpSignal)
-	totalScore += fpSignal.Score * WeightFingerprint
-
-	// 2. IP reputation check
-	ipSignal := checkIPReputation(ip)
-	signals = append(signals, ipSignal)
-	totalScore += ipSignal.Score * WeightIPReputation
-
-	// 3. Email pattern check
-	emailSignal := checkEmailPattern(req.Email)
-	signals = append(signals, emailSignal)
-	totalScore += emailSignal.Score * WeightEmailPattern
-
-	// 4. Browser signals check
-	browserSignal := checkBrowserSignals(req.Fingerprint)
-	signals = append(signals, browserSignal)
-	totalScore += browserSignal.Score * WeightBrowserSignals
+	totalScore, signals := scoreSignals(policy, func(name string, weight float64) (Signal, bool) {
+		switch name {
+		case SignalFingerprint:
+			return checkFingerprintHistory(fingerprintHash), true
+		case SignalIPReputation:
+			return checkIPReputation(ip), true
+		case SignalEmailPattern:
+			return checkEmailPattern(req.Email), true
+		case SignalBrowserSignals:
+			return checkBrowserSignals(req.Fingerprint, geo), true
+		case SignalHosting:
+			return checkIPList(ip, SignalHosting, IPCategoryHosting, weight, "Hosting provider range")
+		case SignalVPN:
+			return checkIPList(ip, SignalVPN, IPCategoryVPN, weight, "Known VPN range")
+		case SignalTor:
+			return checkIPList(ip, SignalTor, IPCategoryTor, weight, "Tor exit node")
+		}
+		return Signal{}, false
+	})
 
 	// Determine recommendation
 	recommendation := "allow"
-	if totalScore < 0.3 {
+	if totalScore < policy.BlockBelow {
 		recommendation = "block"
-	} else if totalScore < 0.6 {
+	} else if totalScore < policy.CaptchaBelow {
 		recommendation = "captcha"
 	}
 
 	// Log trust score check (store fingerprint for tracking)
-	go logTrustCheck(fingerprintHash, ip, req.Fingerprint)
+	go logTrustCheck(fingerprintHash, ip, req.Fingerprint, geo)
 
 	util.WriteJSON(w, http.StatusOK, TrustScoreResponse{
 		Score:          totalScore,
 		Signals:        signals,
 		Recommendation: recommendation,
 		FingerprintID:  fingerprintHash[:16], // Short ID for reference
+		Policy:         policy,
+		Geo:            geo,
 	})
 }
 
-func logTrustCheck(fingerprintHash, ip string, fp FingerprintData) {
+func logTrustCheck(fingerprintHash, ip string, fp FingerprintData, geo *GeoInfo) {
+	location := geoOrEmpty(geo)
 	_, err := database.DB.Exec(
 		context.Background(),
 		`INSERT INTO device_fingerprints 
-		 (fingerprint_hash, ip_address, user_agent, screen_resolution, timezone, language, platform)
-		 VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		 (fingerprint_hash, ip_address, user_agent, screen_resolution, timezone, language, platform,
+		  country, region, asn, as_org)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, NULLIF($8, ''), NULLIF($9, ''), NULLIF($10, 0), NULLIF($11, ''))`,
 		fingerprintHash,
 		ip,
 		fp.UserAgent,
@@ -141,6 +160,10 @@ func logTrustCheck(fingerprintHash, ip string, fp FingerprintData) {
 		fp.Timezone,
 		fp.Language,
 		fp.Platform,
+		location.Country,
+		location.Region,
+		int64(location.ASN),
+		location.ASOrg,
 	)
 	if err != nil {
 		log.Print("Error logging trust check:", err)
@@ -158,15 +181,17 @@ func RecordFingerprint(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ip := getClientIP(r)
+	ip := util.ClientIP(r)
 	fingerprintHash := generateFingerprintHash(req.Fingerprint)
+	location := geoOrEmpty(LookupGeo(ip))
 
 	// Store fingerprint
 	_, err := database.DB.Exec(
 		context.Background(),
 		`INSERT INTO device_fingerprints 
-		 (fingerprint_hash, user_id, ip_address, user_agent, screen_resolution, timezone, language, platform)
-		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		 (fingerprint_hash, user_id, ip_address, user_agent, screen_resolution, timezone, language, platform,
+		  country, region, asn, as_org)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, NULLIF($9, ''), NULLIF($10, ''), NULLIF($11, 0), NULLIF($12, ''))`,
 		fingerprintHash,
 		req.UserID,
 		ip,
@@ -175,6 +200,10 @@ func RecordFingerprint(w http.ResponseWriter, r *http.Request) {
 		req.Fingerprint.Timezone,
 		req.Fingerprint.Language,
 		req.Fingerprint.Platform,
+		location.Country,
+		location.Region,
+		int64(location.ASN),
+		location.ASOrg,
 	)
 
 	if err != nil {
@@ -183,18 +212,8 @@ func RecordFingerprint(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Update IP signup count
-	_, err = database.DB.Exec(
-		context.Background(),
-		`INSERT INTO ip_signups (ip_address, signup_count, first_signup_at, last_signup_at)
-		 VALUES ($1, 1, NOW(), NOW())
-		 ON CONFLICT (ip_address) DO UPDATE SET
-		 signup_count = ip_signups.signup_count + 1,
-		 last_signup_at = NOW()`,
-		ip,
-	)
-
-	if err != nil {
+	// Count the signup in the IP's current hour
+	if err := recordIPSignup(context.Background(), ip); err != nil {
 		log.Print("Error updating IP signups:", err)
 	}
 
@@ -234,32 +253,38 @@ func checkFingerprintHistory(hash string) Signal {
 }
 
 func checkIPReputation(ip string) Signal {
-	var signupCount int
-	var lastSignup time.Time
-
-	err := database.DB.QueryRow(
-		context.Background(),
-		`SELECT signup_count, last_signup_at FROM ip_signups WHERE ip_address = $1`,
-		ip,
-	).Scan(&signupCount, &lastSignup)
+	if lists := matchedLists(ip, IPCategoryDeny); len(lists) > 0 {
+		return Signal{Name: "ip_reputation", Score: 0.0, Reason: "IP on denylist (" + strings.Join(lists, ", ") + ")"}
+	}
 
+	velocity, err := loadIPVelocity(context.Background(), ip)
 	if err != nil {
-		// New IP - good sign
-		return Signal{Name: "ip_reputation", Score: 1.0, Reason: "New IP address"}
+		return Signal{Name: "ip_reputation", Score: 0.5, Reason: "Unable to verify"}
 	}
 
-	// Check daily limit
-	if time.Since(lastSignup) < 24*time.Hour && signupCount >= MaxSignupsPerIPPerDay {
+	// Check daily limits
+	if velocity.IPDay >= MaxSignupsPerIPPerDay {
 		return Signal{Name: "ip_reputation", Score: 0.1, Reason: "Too many signups from this IP today"}
 	}
+	if velocity.PrefixDay >= MaxSignupsPerPrefixPerDay {
+		return Signal{Name: "ip_reputation", Score: 0.2, Reason: "Too many signups from this network today"}
+	}
 
-	// Check weekly limit
-	if time.Since(lastSignup) < 7*24*time.Hour && signupCount >= MaxSignupsPerIPPerWeek {
+	// Check weekly limits
+	if velocity.IPWeek >= MaxSignupsPerIPPerWeek {
 		return Signal{Name: "ip_reputation", Score: 0.2, Reason: "High signup volume from this IP"}
 	}
+	if velocity.PrefixWeek >= MaxSignupsPerPrefixPerWeek {
+		return Signal{Name: "ip_reputation", Score: 0.3, Reason: "High signup volume from this network"}
+	}
+
+	if velocity.IPWeek == 0 {
+		// New IP - good sign
+		return Signal{Name: "ip_reputation", Score: 1.0, Reason: "New IP address"}
+	}
 
-	// Calculate score based on signup count
-	score := 1.0 - (float64(signupCount) * 0.1)
+	// Calculate score based on this week's signups
+	score := 1.0 - (float64(velocity.IPWeek) * 0.1)
 	if score < 0.3 {
 		score = 0.3
 	}
@@ -267,23 +292,82 @@ func checkIPReputation(ip string) Signal {
 	return Signal{Name: "ip_reputation", Score: score, Reason: "Known IP with some history"}
 }
 
+// scoreSignals evaluates the policy's enabled signals in order. The
+// always-evaluated ones are averaged by weight, normalized by the weights'
+// sum so a policy that turns signals off still scores from 0 to 1. The IP list
+// signals are penalties instead: a listed IP caps the total at the signal's
+// score, so a clean IP can't dilute the average and a Tor exit can't be
+// outweighed by a clean fingerprint
+func scoreSignals(policy TrustPolicy, evaluate func(name string, weight float64) (Signal, bool)) (float64, []Signal) {
+	signals := []Signal{}
+	weightedScore := 0.0
+	totalWeight := 0.0
+	scoreCap := 1.0
+
+	for _, name := range signalOrder {
+		signalPolicy, ok := policy.Signals[name]
+		if !ok || !signalPolicy.Enabled {
+			continue
+		}
+
+		signal, evaluated := evaluate(name, signalPolicy.Weight)
+		if !evaluated {
+			continue
+		}
+		signals = append(signals, signal)
+
+		if !slices.Contains(alwaysEvaluated, name) {
+			scoreCap = math.Min(scoreCap, signal.Score)
+			continue
+		}
+		weightedScore += signal.Score * signalPolicy.Weight
+		totalWeight += signalPolicy.Weight
+	}
+
+	// Policies saved before every policy needed an always-evaluated signal can
+	// end up with nothing scored; nothing counts against the request then
+	totalScore := 1.0
+	if totalWeight > 0 {
+		totalScore = weightedScore / totalWeight
+	}
+	return math.Min(totalScore, scoreCap), signals
+}
+
+// checkIPList reports the IP when a list of the category contains it. Its
+// score is the cap the listing puts on the total, 1 - weight. Being on no list
+// says nothing, so an unlisted IP isn't evaluated
+func checkIPList(ip, name, category string, weight float64, listedReason string) (Signal, bool) {
+	lists := matchedLists(ip, category)
+	if len(lists) == 0 {
+		return Signal{}, false
+	}
+	return Signal{Name: name, Score: 1 - weight, Reason: listedReason + " (" + strings.Join(lists, ", ") + ")"}, true
+}
+
 func checkEmailPattern(email string) Signal {
-	parts := strings.Split(email, "@")
-	if len(parts) != 2 {
-		return Signal{Name: "email_pattern", Score: 0.0, Reason: "Invalid email format"}
+	email = strings.ToLower(strings.TrimSpace(email))
+	if signal, ok := checkEmailFormat(email); ok {
+		return signal
 	}
 
-	localPart := parts[0]
-	domain := parts[1]
+	localPart, domain, _ := strings.Cut(email, "@")
 
-	// Check for plus addressing
-	if strings.Contains(localPart, "+") {
-		return Signal{Name: "email_pattern", Score: 0.4, Reason: "Plus addressing detected"}
+	// Check for another spelling of an already registered mailbox. Dots and
+	// alias domains are ordinary spellings, so they only count here
+	var aliasRegistered bool
+	err := database.DB.QueryRow(
+		context.Background(),
+		`SELECT EXISTS(SELECT 1 FROM users WHERE canonical_email_hash = $1 AND email != $2)`,
+		spamservice.CanonicalEmailHash(email),
+		email,
+	).Scan(&aliasRegistered)
+	if err == nil && aliasRegistered {
+		return Signal{Name: "email_pattern", Score: 0.1, Reason: "Mailbox already registered under another address"}
 	}
 
 	// Check for similar emails in database (Levenshtein-like)
 	var similarCount int
-	err := database.DB.QueryRow(
+	err = database.DB.QueryRow(
 		context.Background(),
 		`SELECT COUNT(*) FROM device_fingerprints df
 		 JOIN users u ON df.user_id = u.id
@@ -303,7 +387,22 @@ func checkEmailPattern(email string) Signal {
 	return Signal{Name: "email_pattern", Score: 0.6, Reason: "Some similar emails exist"}
 }
 
-func checkBrowserSignals(fp FingerprintData) Signal {
+// checkEmailFormat scores what the address alone gives away: a malformed
+// address or plus addressing. ok is false when neither applies
+func checkEmailFormat(email string) (Signal, bool) {
+	parts := strings.Split(email, "@")
+	if len(parts) != 2 {
+		return Signal{Name: "email_pattern", Score: 0.0, Reason: "Invalid email format"}, true
+	}
+
+	// Check for plus addressing
+	if strings.Contains(parts[0], "+") {
+		return Signal{Name: "email_pattern", Score: 0.4, Reason: "Plus addressing detected"}, true
+	}
+	return Signal{}, false
+}
+
+func checkBrowserSignals(fp FingerprintData, geo *GeoInfo) Signal {
 	score := 1.0
 	reasons := []string{}
 
@@ -335,6 +434,12 @@ func checkBrowserSignals(fp FingerprintData) Signal {
 		reasons = append(reasons, "unusual hardware")
 	}
 
+	// Check the browser's timezone fits where the IP is
+	if timezoneMismatch(fp.Timezone, geo) {
+		score -= 0.3
+		reasons = append(reasons, "timezone does not match IP location")
+	}
+
 	if score < 0 {
 		score = 0
 	}
@@ -351,6 +456,25 @@ func checkBrowserSignals(fp FingerprintData) Signal {
 // HELPERS
 // =============================================================================
 
+// geoOrEmpty lets a missing lookup be stored as NULL columns
+func geoOrEmpty(geo *GeoInfo) GeoInfo {
+	if geo == nil {
+		return GeoInfo{}
+	}
+	return *geo
+}
+
+// matchedLists names the lists of the category containing the IP
+func matchedLists(ip, category string) []string {
+	lists := []string{}
+	for _, match := range lookupIP(ip) {
+		if match.Category == category && !slices.Contains(lists, match.List) {
+			lists = append(lists, match.List)
+		}
+	}
+	return lists
+}
+
 func generateFingerprintHash(fp FingerprintData) string {
 	// Combine stable fingerprint components
 	data := strings.Join([]string{
@@ -366,28 +490,6 @@ func generateFingerprintHash(fp FingerprintData) string {
 	return hex.EncodeToString(hash[:])
 }
 
-func getClientIP(r *http.Request) string {
-	// Check X-Forwarded-For header (for proxies/load balancers)
-	forwarded := r.Header.Get("X-Forwarded-For")
-	if forwarded != "" {
-		ips := strings.Split(forwarded, ",")
-		return strings.TrimSpace(ips[0])
-	}
-
-	// Check X-Real-IP header
-	realIP := r.Header.Get("X-Real-IP")
-	if realIP != "" {
-		return realIP
-	}
-
-	// Fall back to RemoteAddr
-	ip, _, err := net.SplitHostPort(r.RemoteAddr)
-	if err != nil {
-		return r.RemoteAddr
-	}
-	return ip
-}
-
 func min(a, b int) int {
 	if a < b {
 		return a
@@ -0,0 +1,100 @@
+package trustservice
+
+import (
+	"math"
+	"slices"
+	"testing"
+)
+
+func TestCheckEmailFormat(t *testing.T) {
+	tests := []struct {
+		email     string
+		penalized bool
+		score     float64
+	}{
+		// Ordinary spellings of a mailbox
+		{"first.last@gmail.com", false, 0},
+		{"f.i.r.s.t.last@gmail.com", false, 0},
+		{"firstlast@googlemail.com", false, 0},
+		{"first-last@yahoo.com", false, 0},
+		{"first.last@example.com", false, 0},
+
+		{"first.last+shop@gmail.com", true, 0.4},
+		{"firstlast+1@example.com", true, 0.4},
+		{"not-an-email", true, 0},
+		{"a@b@example.com", true, 0},
+	}
+
+	for _, tt := range tests {
+		signal, penalized := checkEmailFormat(tt.email)
+		if penalized != tt.penalized {
+			t.Errorf("checkEmailFormat(%q) penalized = %v, want %v (%s)", tt.email, penalized, tt.penalized, signal.Reason)
+			continue
+		}
+		if penalized && signal.Score != tt.score {
+			t.Errorf("checkEmailFormat(%q) score = %v, want %v", tt.email, signal.Score, tt.score)
+		}
+	}
+}
+
+func TestScoreSignals(t *testing.T) {
+	policy := defaultTrustPolicy()
+	clean := func(listed string) func(name string, weight float64) (Signal, bool) {
+		return func(name string, weight float64) (Signal, bool) {
+			if !slices.Contains(alwaysEvaluated, name) {
+				if name != listed {
+					return Signal{}, false
+				}
+				return Signal{Name: name, Score: 1 - weight}, true
+			}
+			return Signal{Name: name, Score: 1.0}, true
+		}
+	}
+
+	tests := []struct {
+		name   string
+		listed string
+		want   float64
+	}{
+		{"clean IP", "", 1.0},
+		{"tor exit", SignalTor, 1 - WeightTor},
+		{"vpn", SignalVPN, 1 - WeightVPN},
+		{"hosting", SignalHosting, 1 - WeightHosting},
+	}
+
+	for _, tt := range tests {
+		score, signals := scoreSignals(policy, clean(tt.listed))
+		if math.Abs(score-tt.want) > 1e-9 {
+			t.Errorf("%s: score = %v, want %v", tt.name, score, tt.want)
+		}
+		wantSignals := len(alwaysEvaluated)
+		if tt.listed != "" {
+			wantSignals++
+		}
+		if len(signals) != wantSignals {
+			t.Errorf("%s: %d signals reported, want %d", tt.name, len(signals), wantSignals)
+		}
+	}
+
+	// A Tor exit is blocked even when everything else looks clean
+	score, _ := scoreSignals(policy, clean(SignalTor))
+	if score >= policy.BlockBelow {
+		t.Errorf("tor exit scored %v, want below block_below %v", score, policy.BlockBelow)
+	}
+
+	// Unlisted IPs don't dilute the other signals
+	mixed := func(name string, weight float64) (Signal, bool) {
+		if !slices.Contains(alwaysEvaluated, name) {
+			return Signal{}, false
+		}
+		if name == SignalFingerprint {
+			return Signal{Name: name, Score: 0.0}, true
+		}
+		return Signal{Name: name, Score: 1.0}, true
+	}
+	score, _ = scoreSignals(policy, mixed)
+	want := 1 - WeightFingerprint/(WeightFingerprint+WeightIPReputation+WeightEmailPattern+WeightBrowserSignals)
+	if math.Abs(score-want) > 1e-9 {
+		t.Errorf("score = %v, want %v", score, want)
+	}
+}
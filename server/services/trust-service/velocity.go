@@ -0,0 +1,113 @@
+package trustservice
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"katanaid/database"
+	"katanaid/util"
+)
+
+// Bucket granularities
+const (
+	BucketHour = "hour"
+	BucketDay  = "day"
+)
+
+const (
+	hourBucketRetention = 48 * time.Hour // hours older than this are rolled up into days
+	dayBucketRetention  = 90 * 24 * time.Hour
+	rollupInterval      = 1 * time.Hour
+)
+
+// ipVelocity counts signups from an address and from its /24 or /64 over the
+// last 24 hours and the last 7 calendar days
+type ipVelocity struct {
+	IPDay, IPWeek         int
+	PrefixDay, PrefixWeek int
+}
+
+// recordIPSignup counts a signup in the address's current hour bucket
+func recordIPSignup(ctx context.Context, ip string) error {
+	_, err := database.DB.Exec(
+		ctx,
+		`INSERT INTO ip_signup_buckets (ip_address, ip_prefix, granularity, bucket_start, signup_count)
+		VALUES ($1, $2, $3, date_trunc('hour', NOW()), 1)
+		ON CONFLICT (ip_address, granularity, bucket_start)
+		DO UPDATE SET signup_count = ip_signup_buckets.signup_count + 1`,
+		ip, ipPrefix(ip), BucketHour,
+	)
+	return err
+}
+
+// loadIPVelocity sums the buckets inside each window. The day window is the
+// last 24 hour buckets, which are never rolled up that soon; the week window
+// is 7 calendar days, today and the 6 before it, since day buckets can't be
+// split
+func loadIPVelocity(ctx context.Context, ip string) (ipVelocity, error) {
+	var v ipVelocity
+	err := database.DB.QueryRow(
+		ctx,
+		`SELECT
+			COALESCE(SUM(signup_count) FILTER (WHERE ip_address = $1 AND bucket_start > NOW() - INTERVAL '24 hours'), 0),
+			COALESCE(SUM(signup_count) FILTER (WHERE ip_address = $1), 0),
+			COALESCE(SUM(signup_count) FILTER (WHERE bucket_start > NOW() - INTERVAL '24 hours'), 0),
+			COALESCE(SUM(signup_count), 0)
+		FROM ip_signup_buckets
+		WHERE ip_prefix = $2 AND bucket_start >= date_trunc('day', NOW()) - INTERVAL '6 days'`,
+		ip, ipPrefix(ip),
+	).Scan(&v.IPDay, &v.IPWeek, &v.PrefixDay, &v.PrefixWeek)
+	return v, err
+}
+
+// StartVelocityRollup periodically folds old hour buckets into day buckets and
+// drops day buckets past retention. Each pass is a single statement, so
+// several servers running it at once can't count a signup twice
+func StartVelocityRollup() {
+	go func() {
+		for {
+			if err := rollupIPBuckets(context.Background()); err != nil {
+				log.Print("Error rolling up IP signup buckets:", err)
+			}
+			time.Sleep(rollupInterval)
+		}
+	}()
+}
+
+func rollupIPBuckets(ctx context.Context) error {
+	_, err := database.DB.Exec(
+		ctx,
+		`WITH moved AS (
+			DELETE FROM ip_signup_buckets
+			WHERE granularity = $1 AND bucket_start < NOW() - make_interval(secs => $3)
+			RETURNING ip_address, ip_prefix, bucket_start, signup_count
+		)
+		INSERT INTO ip_signup_buckets (ip_address, ip_prefix, granularity, bucket_start, signup_count)
+		SELECT ip_address, ip_prefix, $2, date_trunc('day', bucket_start), SUM(signup_count)
+		FROM moved
+		GROUP BY ip_address, ip_prefix, date_trunc('day', bucket_start)
+		ON CONFLICT (ip_address, granularity, bucket_start)
+		DO UPDATE SET signup_count = ip_signup_buckets.signup_count + EXCLUDED.signup_count`,
+		BucketHour, BucketDay, hourBucketRetention.Seconds(),
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = database.DB.Exec(
+		ctx,
+		`DELETE FROM ip_signup_buckets WHERE granularity = $1 AND bucket_start < NOW() - make_interval(secs => $2)`,
+		BucketDay, dayBucketRetention.Seconds(),
+	)
+	return err
+}
+
+// ipPrefix groups an address with its /24 or /64. Anything unparseable is its
+// own group
+func ipPrefix(ip string) string {
+	if prefix := util.IPPrefix(ip); prefix != "" {
+		return prefix
+	}
+	return ip
+}
@@ -0,0 +1,200 @@
+package util
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// Forwarding headers a proxy can be trusted to set
+const (
+	ProxyHeaderXForwardedFor = "x-forwarded-for"
+	ProxyHeaderForwarded     = "forwarded"
+	ProxyHeaderXRealIP       = "x-real-ip"
+)
+
+// trustedProxies are the networks whose forwarding header is believed
+var trustedProxies = defaultTrustedProxies()
+
+// proxyHeader is the one header the proxies set. The others are passed
+// through untouched from the client, so they are never read
+var proxyHeader = ProxyHeaderXForwardedFor
+
+func defaultTrustedProxies() []netip.Prefix {
+	return []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8"), netip.MustParsePrefix("::1/128")}
+}
+
+// InitTrustedProxies reads TRUSTED_PROXIES, a comma-separated list of CIDRs
+// or addresses of the load balancers and proxies in front of the server, and
+// TRUSTED_PROXY_HEADER, the header they set: x-forwarded-for (the default),
+// forwarded or x-real-ip. Without TRUSTED_PROXIES only loopback proxies are
+// trusted
+func InitTrustedProxies() error {
+	switch header := strings.ToLower(strings.TrimSpace(os.Getenv("TRUSTED_PROXY_HEADER"))); header {
+	case "":
+		proxyHeader = ProxyHeaderXForwardedFor
+	case ProxyHeaderXForwardedFor, ProxyHeaderForwarded, ProxyHeaderXRealIP:
+		proxyHeader = header
+	default:
+		return fmt.Errorf("invalid TRUSTED_PROXY_HEADER %q: use x-forwarded-for, forwarded or x-real-ip", header)
+	}
+
+	value := strings.TrimSpace(os.Getenv("TRUSTED_PROXIES"))
+	if value == "" {
+		trustedProxies = defaultTrustedProxies()
+		return nil
+	}
+
+	proxies := []netip.Prefix{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if prefix, err := netip.ParsePrefix(entry); err == nil {
+			proxies = append(proxies, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(entry)
+		if err != nil {
+			return fmt.Errorf("invalid TRUSTED_PROXIES entry %q", entry)
+		}
+		proxies = append(proxies, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+	}
+
+	trustedProxies = proxies
+	return nil
+}
+
+// ClientIP returns the address of the client that made the request.
+// Only the configured forwarding header is read, and only when the connection
+// comes from a trusted proxy. A list header is walked from the right: each hop
+// appends the address it received from, so the first untrusted address is the
+// furthest one that can't have been forged by the client
+func ClientIP(r *http.Request) string {
+	remote := remoteAddr(r)
+	if !remote.IsValid() {
+		return r.RemoteAddr
+	}
+	if !isTrustedProxy(remote) {
+		return remote.String()
+	}
+
+	var hops []string
+	switch proxyHeader {
+	case ProxyHeaderForwarded:
+		hops = forwardedFor(r.Header.Values("Forwarded"))
+	case ProxyHeaderXRealIP:
+		// The proxy overwrites it, so its single value is the client
+		if realIP, err := parseHop(strings.TrimSpace(r.Header.Get("X-Real-IP"))); err == nil {
+			return realIP.String()
+		}
+	default:
+		hops = xForwardedFor(r.Header.Values("X-Forwarded-For"))
+	}
+	if len(hops) == 0 {
+		return remote.String()
+	}
+
+	client := remote
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := parseHop(hops[i])
+		if err != nil {
+			break // unknown or obfuscated: nothing further left can be trusted
+		}
+		client = hop
+		if !isTrustedProxy(hop) {
+			break
+		}
+	}
+	return client.String()
+}
+
+func remoteAddr(r *http.Request) netip.Addr {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}
+	}
+	return addr.Unmap()
+}
+
+func isTrustedProxy(addr netip.Addr) bool {
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// xForwardedFor lists the hops of every X-Forwarded-For header, in order
+func xForwardedFor(headers []string) []string {
+	hops := []string{}
+	for _, header := range headers {
+		for _, hop := range strings.Split(header, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	return hops
+}
+
+// forwardedFor lists the for= node of each Forwarded element, in order.
+// Elements without one are kept as "unknown" so the walk stops there
+func forwardedFor(headers []string) []string {
+	hops := []string{}
+	for _, header := range headers {
+		for _, element := range strings.Split(header, ",") {
+			if strings.TrimSpace(element) == "" {
+				continue
+			}
+			node := "unknown"
+			for _, pair := range strings.Split(element, ";") {
+				name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(name, "for") {
+					node = strings.Trim(value, `"`)
+				}
+			}
+			hops = append(hops, node)
+		}
+	}
+	return hops
+}
+
+// parseHop reads an address with an optional port, such as 192.0.2.1,
+// 192.0.2.1:8080, 2001:db8::1 or [2001:db8::1]:8080
+func parseHop(hop string) (netip.Addr, error) {
+	if addrPort, err := netip.ParseAddrPort(hop); err == nil {
+		return addrPort.Addr().Unmap(), nil
+	}
+	addr, err := netip.ParseAddr(strings.Trim(hop, "[]"))
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	return addr.Unmap(), nil
+}
+
+// IPPrefix returns the /24 (IPv4) or /64 (IPv6) network containing ip, which
+// is roughly what a single customer or device controls
+func IPPrefix(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ""
+	}
+
+	if v4 := parsed.To4(); v4 != nil {
+		network := &net.IPNet{IP: v4.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}
+		return network.String()
+	}
+
+	network := &net.IPNet{IP: parsed.Mask(net.CIDRMask(64, 128)), Mask: net.CIDRMask(64, 128)}
+	return network.String()
+}
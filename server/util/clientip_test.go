@@ -0,0 +1,134 @@
+package util
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name       string
+		proxies    string
+		header     string
+		remoteAddr string
+		headers    map[string]string
+		want       string
+	}{
+		{
+			name:       "direct connection",
+			remoteAddr: "203.0.113.5:4321",
+			want:       "203.0.113.5",
+		},
+		{
+			name:       "untrusted peer spoofing every header",
+			remoteAddr: "203.0.113.5:4321",
+			headers: map[string]string{
+				"X-Forwarded-For": "198.51.100.1",
+				"Forwarded":       "for=198.51.100.2",
+				"X-Real-IP":       "198.51.100.3",
+			},
+			want: "203.0.113.5",
+		},
+		{
+			name:       "x-forwarded-for from the proxy",
+			remoteAddr: "127.0.0.1:4321",
+			headers:    map[string]string{"X-Forwarded-For": "203.0.113.5"},
+			want:       "203.0.113.5",
+		},
+		{
+			name:       "spoofed entries left of the proxy's",
+			remoteAddr: "127.0.0.1:4321",
+			headers:    map[string]string{"X-Forwarded-For": "198.51.100.1, 203.0.113.5"},
+			want:       "203.0.113.5",
+		},
+		{
+			name:       "forwarded ignored when x-forwarded-for is configured",
+			remoteAddr: "127.0.0.1:4321",
+			headers: map[string]string{
+				"Forwarded":       "for=198.51.100.2",
+				"X-Forwarded-For": "203.0.113.5",
+			},
+			want: "203.0.113.5",
+		},
+		{
+			name:       "x-real-ip ignored when x-forwarded-for is configured",
+			remoteAddr: "127.0.0.1:4321",
+			headers:    map[string]string{"X-Real-IP": "198.51.100.3"},
+			want:       "127.0.0.1",
+		},
+		{
+			name:       "chain of trusted proxies",
+			proxies:    "10.0.0.0/8",
+			remoteAddr: "10.0.0.2:4321",
+			headers:    map[string]string{"X-Forwarded-For": "198.51.100.1, 203.0.113.5, 10.0.0.1"},
+			want:       "203.0.113.5",
+		},
+		{
+			name:       "forwarded from the proxy",
+			header:     ProxyHeaderForwarded,
+			remoteAddr: "127.0.0.1:4321",
+			headers:    map[string]string{"Forwarded": `for=198.51.100.2, for="[2001:db8::1]:8080";proto=https`},
+			want:       "2001:db8::1",
+		},
+		{
+			name:       "x-forwarded-for ignored when forwarded is configured",
+			header:     ProxyHeaderForwarded,
+			remoteAddr: "127.0.0.1:4321",
+			headers:    map[string]string{"X-Forwarded-For": "198.51.100.1"},
+			want:       "127.0.0.1",
+		},
+		{
+			name:       "obfuscated forwarded node stops the walk",
+			header:     ProxyHeaderForwarded,
+			proxies:    "10.0.0.0/8",
+			remoteAddr: "10.0.0.2:4321",
+			headers:    map[string]string{"Forwarded": "for=198.51.100.2, for=_hidden, for=10.0.0.1"},
+			want:       "10.0.0.1",
+		},
+		{
+			name:       "x-real-ip from the proxy",
+			header:     ProxyHeaderXRealIP,
+			remoteAddr: "127.0.0.1:4321",
+			headers: map[string]string{
+				"X-Real-IP":       "203.0.113.5",
+				"X-Forwarded-For": "198.51.100.1",
+			},
+			want: "203.0.113.5",
+		},
+		{
+			name:       "x-real-ip missing",
+			header:     ProxyHeaderXRealIP,
+			remoteAddr: "127.0.0.1:4321",
+			headers:    map[string]string{"Forwarded": "for=198.51.100.2"},
+			want:       "127.0.0.1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("TRUSTED_PROXIES", tt.proxies)
+			t.Setenv("TRUSTED_PROXY_HEADER", tt.header)
+			if err := InitTrustedProxies(); err != nil {
+				t.Fatal(err)
+			}
+
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for name, value := range tt.headers {
+				r.Header.Set(name, value)
+			}
+
+			if got := ClientIP(r); got != tt.want {
+				t.Errorf("ClientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInitTrustedProxiesRejectsUnknownHeader(t *testing.T) {
+	t.Setenv("TRUSTED_PROXIES", "")
+	t.Setenv("TRUSTED_PROXY_HEADER", "x-client-ip")
+	if err := InitTrustedProxies(); err == nil {
+		t.Error("InitTrustedProxies accepted an unknown header")
+	}
+}